@@ -0,0 +1,293 @@
+package backfill
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kwoodhouse93/trail-progress-worker/store"
+	"github.com/kwoodhouse93/trail-progress-worker/strava"
+	"github.com/kwoodhouse93/trail-progress-worker/tokens"
+	"github.com/pkg/errors"
+)
+
+type Store interface {
+	StoreActivity(ctx context.Context, athleteID int, activity strava.DetailedActivity, detailedTrack []strava.LatLong, eventTime int) error
+	GetBackfillCursor(ctx context.Context, athleteID int) (*store.BackfillCursor, error)
+	StartBackfill(ctx context.Context, athleteID int) error
+	SaveBackfillCursor(ctx context.Context, athleteID int, after time.Time, completed bool) error
+	IncompleteBackfills(ctx context.Context) ([]int, error)
+	SetNeedsReauthorization(ctx context.Context, athleteID int, reason string) error
+	ClaimBackfill(ctx context.Context, athleteID int, owner string, lease time.Duration) (bool, error)
+	ReleaseBackfill(ctx context.Context, athleteID int, owner string) error
+}
+
+// How long a claim on an athlete's backfill lasts. It's renewed well before
+// then while the backfill runs, so this is how long another instance waits to
+// take over if we die.
+const claimLease = 5 * time.Minute
+
+var errLostClaim = errors.New("backfill: lost claim to another instance")
+
+type TokenSource interface {
+	AccessToken(ctx context.Context, athleteID int) (*store.AccessToken, error)
+}
+
+// Backfiller imports athletes' activity history from Strava, one athlete at a time.
+type Backfiller struct {
+	// Identifies this instance's claims on backfills.
+	id        string
+	stravaAPI *strava.API
+	store     Store
+	tokens    TokenSource
+	queue     chan int
+	pageSize  int
+	// Pause when usage reaches this fraction of either rate limit, leaving the
+	// rest for fetching activities from webhook events.
+	maxUsage float64
+}
+
+func New(stravaAPI *strava.API, store Store, tokens TokenSource, pageSize int, maxUsage float64) *Backfiller {
+	return &Backfiller{
+		id:        uuid.NewString(),
+		stravaAPI: stravaAPI,
+		store:     store,
+		tokens:    tokens,
+		queue:     make(chan int, 100),
+		pageSize:  pageSize,
+		maxUsage:  maxUsage,
+	}
+}
+
+// Enqueue records that the athlete needs a backfill and queues it to run.
+// The backfill is resumed on restart if it doesn't complete.
+func (b *Backfiller) Enqueue(ctx context.Context, athleteID int) error {
+	err := b.store.StartBackfill(ctx, athleteID)
+	if err != nil {
+		return errors.Wrap(err, "backfill: failed to start backfill")
+	}
+	select {
+	case b.queue <- athleteID:
+	default:
+		log.Printf("backfill: queue full, athlete %d will be backfilled on restart", athleteID)
+	}
+	return nil
+}
+
+// Serve resumes any incomplete backfills, then runs queued backfills until ctx is done.
+func (b *Backfiller) Serve(ctx context.Context) error {
+	athleteIDs, err := b.store.IncompleteBackfills(ctx)
+	if err != nil {
+		return errors.Wrap(err, "backfill: failed to get incomplete backfills")
+	}
+	log.Printf("backfill: resuming %d incomplete backfill(s)", len(athleteIDs))
+	for _, athleteID := range athleteIDs {
+		b.run(ctx, athleteID)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case athleteID := <-b.queue:
+			b.run(ctx, athleteID)
+		}
+	}
+}
+
+func (b *Backfiller) run(ctx context.Context, athleteID int) {
+	// Every instance resumes incomplete backfills, so claim the athlete first,
+	// rather than fetching their history, and using up the rate limits, twice.
+	claimed, err := b.store.ClaimBackfill(ctx, athleteID, b.id, claimLease)
+	if err != nil {
+		log.Printf("backfill: failed to claim athlete %d: %v", athleteID, err)
+		return
+	}
+	if !claimed {
+		log.Printf("backfill: athlete %d is being backfilled by another instance, skipping", athleteID)
+		return
+	}
+	defer func() {
+		// Release promptly, even if we're shutting down, so another instance
+		// can take over without waiting for the claim to expire.
+		releaseCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		err := b.store.ReleaseBackfill(releaseCtx, athleteID, b.id)
+		if err != nil {
+			log.Printf("backfill: failed to release claim on athlete %d: %v", athleteID, err)
+		}
+	}()
+
+	err = b.Backfill(ctx, athleteID)
+	if err != nil {
+		// The cursor is left incomplete, so we'll try again on restart.
+		log.Printf("backfill: failed to backfill athlete %d: %v", athleteID, err)
+	}
+}
+
+// Backfill pages through the athlete's activities, oldest first, starting
+// from their saved cursor.
+func (b *Backfiller) Backfill(ctx context.Context, athleteID int) error {
+	cursor, err := b.store.GetBackfillCursor(ctx, athleteID)
+	if err != nil {
+		return errors.Wrap(err, "backfill: failed to get cursor")
+	}
+	if cursor.CompletedAt != nil {
+		return nil
+	}
+	log.Printf("backfill: backfilling athlete %d from %v", athleteID, cursor.After)
+
+	after := cursor.After
+	imported := 0
+	for {
+		err = b.renewClaim(ctx, athleteID)
+		if err != nil {
+			return err
+		}
+		err = b.waitForRateLimit(ctx, athleteID)
+		if err != nil {
+			return err
+		}
+
+		token, err := b.tokens.AccessToken(ctx, athleteID)
+		if err != nil {
+			if errors.Is(err, tokens.ErrDeauthorized) {
+				log.Printf("backfill: athlete %d has deauthorized us, stopping backfill", athleteID)
+				return nil
+			}
+			return errors.Wrap(err, "backfill: failed to get access token")
+		}
+		if !token.HasScope(strava.ScopeActivityRead) {
+			// Leave the cursor incomplete, so the backfill resumes once they reauthorize.
+			return b.needsReauthorization(ctx, athleteID, "activity:read scope not granted")
+		}
+		// Always fetch the first page after the cursor, rather than paging by
+		// number, so activities added or deleted meanwhile don't shift pages.
+		// Strava's after is exclusive, so go back a second, in case another
+		// activity started at the same time as the cursor's. Storing the
+		// cursor's activities again leaves them as they are.
+		activities, err := b.stravaAPI.ListAthleteActivitiesWithContext(ctx, strava.ListAthleteActivitiesRequest{
+			AccessToken: token.Token,
+			After:       after.Add(-time.Second),
+			Page:        1,
+			PerPage:     b.pageSize,
+		})
+		if err != nil {
+			if strava.IsRateLimited(err) {
+				// Strava may not have told us our usage, in which case
+				// waitForRateLimit won't wait, so wait for the limit to reset here.
+				rateLimit := b.stravaAPI.RateLimit()
+				resumeAt := rateLimit.ShortTermResetsAt()
+				if rateLimit.LongTermExhausted() {
+					resumeAt = rateLimit.LongTermResetsAt()
+				}
+				log.Printf("backfill: rate limited while backfilling athlete %d", athleteID)
+				err = b.pauseUntil(ctx, athleteID, resumeAt, rateLimit)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if strava.IsUnauthorized(err) || strava.IsForbidden(err) {
+				return b.needsReauthorization(ctx, athleteID, err.Error())
+			}
+			return errors.Wrap(err, "backfill: failed to list activities")
+		}
+
+		newer := false
+		for _, activity := range activities {
+			err = b.store.StoreActivity(ctx, athleteID, activity, nil, 0)
+			if err != nil {
+				return errors.Wrapf(err, "backfill: failed to store activity %d", activity.ID)
+			}
+			if activity.StartDate.After(after) {
+				after = activity.StartDate
+				newer = true
+			}
+		}
+		// Only the cursor's activities were left.
+		if !newer {
+			err = b.store.SaveBackfillCursor(ctx, athleteID, after, true)
+			if err != nil {
+				return errors.Wrap(err, "backfill: failed to save cursor")
+			}
+			log.Printf("backfill: finished backfilling athlete %d - imported %d activities", athleteID, imported)
+			return nil
+		}
+		imported += len(activities)
+
+		err = b.store.SaveBackfillCursor(ctx, athleteID, after, false)
+		if err != nil {
+			return errors.Wrap(err, "backfill: failed to save cursor")
+		}
+	}
+}
+
+func (b *Backfiller) needsReauthorization(ctx context.Context, athleteID int, reason string) error {
+	log.Printf("backfill: athlete %d needs reauthorization: %s", athleteID, reason)
+	err := b.store.SetNeedsReauthorization(ctx, athleteID, reason)
+	if err != nil {
+		return errors.Wrap(err, "backfill: failed to record athlete needs reauthorization")
+	}
+	return nil
+}
+
+// Blocks until usage is below maxUsage of both rate limits.
+func (b *Backfiller) waitForRateLimit(ctx context.Context, athleteID int) error {
+	for {
+		rateLimit := b.stravaAPI.RateLimit()
+		var resumeAt time.Time
+		switch {
+		case overUsage(rateLimit.LongTermUsage, rateLimit.LongTermLimit, b.maxUsage):
+			resumeAt = rateLimit.LongTermResetsAt()
+		case overUsage(rateLimit.ShortTermUsage, rateLimit.ShortTermLimit, b.maxUsage):
+			resumeAt = rateLimit.ShortTermResetsAt()
+		default:
+			return nil
+		}
+
+		err := b.pauseUntil(ctx, athleteID, resumeAt, rateLimit)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Keeps renewing our claim on the athlete's backfill while we wait, since
+// the daily limit can take hours to reset.
+func (b *Backfiller) pauseUntil(ctx context.Context, athleteID int, resumeAt time.Time, rateLimit strava.RateLimit) error {
+	log.Printf("backfill: pausing until %v, rate limit usage: %+v", resumeAt, rateLimit)
+	timer := time.NewTimer(time.Until(resumeAt))
+	defer timer.Stop()
+	renew := time.NewTicker(claimLease / 3)
+	defer renew.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		case <-renew.C:
+			err := b.renewClaim(ctx, athleteID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (b *Backfiller) renewClaim(ctx context.Context, athleteID int) error {
+	claimed, err := b.store.ClaimBackfill(ctx, athleteID, b.id, claimLease)
+	if err != nil {
+		return errors.Wrap(err, "backfill: failed to renew claim")
+	}
+	if !claimed {
+		return errLostClaim
+	}
+	return nil
+}
+
+func overUsage(usage, limit int, maxUsage float64) bool {
+	return limit > 0 && float64(usage) >= float64(limit)*maxUsage
+}
@@ -0,0 +1,127 @@
+package leader
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/kwoodhouse93/trail-progress-worker/store"
+)
+
+// Published on /debug/vars. 1 for each task this instance currently leads.
+var leaderMetrics = expvar.NewMap("leader")
+
+// Elector makes sure a task runs on exactly one instance at a time, using a
+// Postgres advisory lock to choose which. If the leader dies, its connection
+// closes, the lock is released, and another instance takes over.
+type Elector struct {
+	store *store.Store
+	name  string
+	key   int64
+	// How often to try to become leader, and to check we still are.
+	interval time.Duration
+	leading  *int32
+}
+
+// name identifies the task. Instances campaigning with the same name compete
+// for the same lock.
+func New(store *store.Store, name string, interval time.Duration) *Elector {
+	return &Elector{
+		store:    store,
+		name:     name,
+		key:      lockKey(name),
+		interval: interval,
+		leading:  new(int32),
+	}
+}
+
+// New's store parameter shadows the package.
+func lockKey(name string) int64 {
+	return store.AdvisoryLockKey(name)
+}
+
+// IsLeader reports whether this instance is currently the leader.
+func (e *Elector) IsLeader() bool {
+	return atomic.LoadInt32(e.leading) == 1
+}
+
+// Run campaigns for leadership until ctx is done. Each time this instance
+// becomes leader, it calls lead with a context that's cancelled if leadership
+// is lost or ctx is done. Leadership is released when lead returns.
+func (e *Elector) Run(ctx context.Context, lead func(ctx context.Context)) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		lock, err := e.store.TryAdvisoryLock(ctx, e.key)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("leader: failed to campaign for %s: %v", e.name, err)
+		}
+		if lock != nil {
+			e.lead(ctx, lock, lead)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Elector) lead(ctx context.Context, lock *store.AdvisoryLock, lead func(ctx context.Context)) {
+	log.Printf("leader: became leader for %s", e.name)
+	atomic.StoreInt32(e.leading, 1)
+	leaderMetrics.Set(e.name, expvarInt(1))
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		lead(leaderCtx)
+		close(done)
+	}()
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+loop:
+	for {
+		select {
+		case <-done:
+			break loop
+		case <-ticker.C:
+			err := lock.Check(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("leader: lost leadership for %s: %v", e.name, err)
+				cancel()
+				<-done
+				break loop
+			}
+		}
+	}
+	cancel()
+
+	atomic.StoreInt32(e.leading, 0)
+	leaderMetrics.Set(e.name, expvarInt(0))
+
+	// Release promptly, even if we're shutting down, so another instance can
+	// take over without waiting for our connection to close.
+	releaseCtx, cancelRelease := context.WithTimeout(context.Background(), time.Second)
+	defer cancelRelease()
+	err := lock.Release(releaseCtx)
+	if err != nil {
+		log.Printf("leader: failed to release leadership for %s: %v", e.name, err)
+		return
+	}
+	log.Printf("leader: released leadership for %s", e.name)
+}
+
+func expvarInt(v int64) *expvar.Int {
+	i := new(expvar.Int)
+	i.Set(v)
+	return i
+}
@@ -2,16 +2,22 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
 
+	"github.com/kwoodhouse93/trail-progress-worker/backfill"
 	"github.com/kwoodhouse93/trail-progress-worker/handler"
+	"github.com/kwoodhouse93/trail-progress-worker/leader"
 	"github.com/kwoodhouse93/trail-progress-worker/processor"
 	"github.com/kwoodhouse93/trail-progress-worker/store"
+	"github.com/kwoodhouse93/trail-progress-worker/strava"
+	"github.com/kwoodhouse93/trail-progress-worker/tokens"
 	"github.com/kwoodhouse93/trail-progress-worker/webhooks"
 )
 
@@ -19,6 +25,35 @@ type ProcessorConfig struct {
 	Interval    time.Duration `required:"true" envconfig:"INTERVAL"`
 	Concurrency int           `default:"1" envconfig:"CONCURRENCY"`
 	BatchSize   int           `default:"10" envconfig:"BATCH_SIZE"`
+	// How long a worker's claim on a batch lasts before it's assumed dead.
+	Lease time.Duration `default:"10m" envconfig:"LEASE"`
+	// How many times to try an activity/route pair that fails before giving up on it.
+	MaxAttempts int `default:"3" envconfig:"MAX_ATTEMPTS"`
+	// Defaults for routes that don't set their own.
+	BufferDistance     float64 `default:"200" envconfig:"BUFFER_DISTANCE"`
+	RelevanceTolerance float64 `default:"0.001" envconfig:"RELEVANCE_TOLERANCE"`
+}
+
+type InboxConfig struct {
+	Workers      int           `default:"2" envconfig:"WORKERS"`
+	PollInterval time.Duration `default:"10s" envconfig:"POLL_INTERVAL"`
+	MaxAttempts  int           `default:"8" envconfig:"MAX_ATTEMPTS"`
+}
+
+type BackfillConfig struct {
+	PageSize int `default:"100" envconfig:"PAGE_SIZE"`
+	// Fraction of the Strava rate limits the backfill may use before pausing.
+	MaxRateLimitUsage float64 `default:"0.8" envconfig:"MAX_RATE_LIMIT_USAGE"`
+}
+
+type LeaderConfig struct {
+	// How often instances try to become leader, and the leader checks it still is.
+	Interval time.Duration `default:"15s" envconfig:"INTERVAL"`
+}
+
+type DebugConfig struct {
+	// Where to serve /debug/vars. Keep it off the public webhook port. Empty to disable.
+	Addr string `default:"127.0.0.1:9091" envconfig:"ADDR"`
 }
 
 type PostgresConfig struct {
@@ -30,31 +65,150 @@ type StravaConfig struct {
 	ClientID     int    `required:"true" envconfig:"CLIENT_ID"`
 	ClientSecret string `required:"true" envconfig:"CLIENT_SECRET"`
 	CallbackURL  string `required:"true" envconfig:"CALLBACK_URL"`
+
+	// Appended to the callback URL's path, so only Strava knows where to send events.
+	CallbackSecret string `envconfig:"CALLBACK_SECRET"`
+
+	// Whether to fetch full resolution GPS tracks for new activities.
+	// Uses an extra API request per activity.
+	FetchStreams bool `default:"false" envconfig:"FETCH_STREAMS"`
+
+	// Secret for signing OAuth state. Enables the /oauth/authorize and
+	// /oauth/callback routes for onboarding athletes if set.
+	OAuthStateSecret string `envconfig:"OAUTH_STATE_SECRET"`
+	// Where to send athletes once they've connected their Strava account.
+	OAuthSuccessURL string `envconfig:"OAUTH_SUCCESS_URL"`
+
+	// Delete the webhook subscription on shutdown. Off by default, so events
+	// aren't lost while another instance takes over.
+	DeleteSubscriptionOnShutdown bool `default:"false" envconfig:"DELETE_SUBSCRIPTION_ON_SHUTDOWN"`
+	// How often the leader checks the webhook subscription still exists.
+	SubscriptionReconcileInterval time.Duration `default:"15m" envconfig:"SUBSCRIPTION_RECONCILE_INTERVAL"`
+	// Warn if no webhook events have been received for this long.
+	EventWarningThreshold time.Duration `default:"24h" envconfig:"EVENT_WARNING_THRESHOLD"`
+
+	// Optional overrides, e.g. for pointing staging at a local stand-in.
+	BaseURL   string        `envconfig:"BASE_URL"`
+	UserAgent string        `default:"trail-progress-worker" envconfig:"USER_AGENT"`
+	Timeout   time.Duration `default:"30s" envconfig:"TIMEOUT"`
+
+	// Per-call deadlines, applied on top of the caller's context.
+	GetActivityTimeout  time.Duration `default:"10s" envconfig:"GET_ACTIVITY_TIMEOUT"`
+	RefreshTokenTimeout time.Duration `default:"10s" envconfig:"REFRESH_TOKEN_TIMEOUT"`
+	SubscriptionTimeout time.Duration `default:"30s" envconfig:"SUBSCRIPTION_TIMEOUT"`
+
+	// Refresh access tokens this long before they expire.
+	TokenRefreshMargin time.Duration `default:"5m" envconfig:"TOKEN_REFRESH_MARGIN"`
+
+	// How many times to attempt idempotent requests that fail transiently.
+	MaxAttempts int `default:"3" envconfig:"MAX_ATTEMPTS"`
+
+	// How long a request may wait for the 15 minute rate limit window to reset.
+	RateLimitMaxWait time.Duration `default:"0s" envconfig:"RATE_LIMIT_MAX_WAIT"`
+}
+
+type EncryptionConfig struct {
+	// Keys for encrypting tokens at rest, as "id1:base64key1,id2:base64key2".
+	// Each key must be 32 random bytes. Tokens are stored in plaintext if unset.
+	Keys string `envconfig:"KEYS"`
+	// ID of the key to encrypt new tokens with.
+	KeyID string `envconfig:"KEY_ID"`
 }
 
 type Config struct {
-	Processor ProcessorConfig
-	Postgres  PostgresConfig
-	Strava    StravaConfig
+	Processor  ProcessorConfig
+	Encryption EncryptionConfig
+	Inbox      InboxConfig
+	Backfill   BackfillConfig
+	Debug      DebugConfig
+	Leader     LeaderConfig
+	Postgres   PostgresConfig
+	Strava     StravaConfig
 }
 
+// Fly gives us 5 seconds (kill_timeout) to shut down after SIGINT.
+const shutdownTimeout = 4 * time.Second
+
 func main() {
 	config := Config{}
 	err := envconfig.Process("", &config)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if config.Processor.Lease <= 0 {
+		log.Fatal("PROCESSOR_LEASE must be positive")
+	}
 
-	store, err := store.New(config.Postgres.ConnectionURL)
+	var keyring *store.Keyring
+	if config.Encryption.Keys != "" {
+		keys, err := store.ParseKeys(config.Encryption.Keys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		keyring, err = store.NewKeyring(config.Encryption.KeyID, keys)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		log.Println("no encryption keys configured, tokens will be stored in plaintext")
+	}
+
+	store, err := store.New(config.Postgres.ConnectionURL, keyring)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer store.Cleanup()
 
+	// One-off maintenance commands, e.g. `/process reencrypt-tokens`.
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], store)
+		return
+	}
+
 	handler := handler.New()
 
+	stravaOpts := []strava.Option{
+		strava.WithUserAgent(config.Strava.UserAgent),
+		strava.WithTimeout(config.Strava.Timeout),
+		strava.WithTimeouts(strava.Timeouts{
+			GetActivity:  config.Strava.GetActivityTimeout,
+			RefreshToken: config.Strava.RefreshTokenTimeout,
+			Subscription: config.Strava.SubscriptionTimeout,
+		}),
+		strava.WithRetryPolicy(strava.RetryPolicy{
+			MaxAttempts: config.Strava.MaxAttempts,
+			BaseDelay:   500 * time.Millisecond,
+			MaxDelay:    10 * time.Second,
+		}),
+		strava.WithRateLimiter(strava.NewRateLimiter(config.Strava.RateLimitMaxWait)),
+	}
+	if config.Strava.BaseURL != "" {
+		stravaOpts = append(stravaOpts, strava.WithBaseURL(config.Strava.BaseURL))
+	}
+	stravaAPI := strava.NewAPI(config.Strava.ClientID, config.Strava.ClientSecret, stravaOpts...)
+
+	tokens := tokens.New(stravaAPI, store, config.Strava.TokenRefreshMargin)
+	backfiller := backfill.New(stravaAPI, store, tokens, config.Backfill.PageSize, config.Backfill.MaxRateLimitUsage)
+
+	// Only one instance manages the webhook subscription at a time.
+	elector := leader.New(store, "webhook-subscription:"+config.Strava.CallbackURL, config.Leader.Interval)
+
 	log.Println("starting webhook subscription")
-	subscription, err := webhooks.NewSubscription(config.Strava.ClientID, config.Strava.ClientSecret, config.Strava.CallbackURL, store)
+	subscription, err := webhooks.NewSubscription(context.Background(), stravaAPI, store, tokens, backfiller, elector, webhooks.Config{
+		CallbackURL:      config.Strava.CallbackURL,
+		CallbackSecret:   config.Strava.CallbackSecret,
+		FetchStreams:     config.Strava.FetchStreams,
+		OAuthStateSecret: config.Strava.OAuthStateSecret,
+		OAuthSuccessURL:  config.Strava.OAuthSuccessURL,
+
+		DeleteSubscriptionOnClose: config.Strava.DeleteSubscriptionOnShutdown,
+		ReconcileInterval:         config.Strava.SubscriptionReconcileInterval,
+		EventWarningThreshold:     config.Strava.EventWarningThreshold,
+
+		InboxWorkers:      config.Inbox.Workers,
+		InboxPollInterval: config.Inbox.PollInterval,
+		InboxMaxAttempts:  config.Inbox.MaxAttempts,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -66,13 +220,41 @@ func main() {
 	go func() {
 		<-stop
 		log.Println("sigint received")
-		subscription.Close(context.Background())
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+		subscription.Close(shutdownCtx)
+		cancelShutdown()
 		cancel()
 	}()
 
+	if config.Debug.Addr != "" {
+		log.Println("starting debug server on", config.Debug.Addr)
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/debug/vars", expvar.Handler())
+			err := http.ListenAndServe(config.Debug.Addr, mux)
+			log.Println("debug server stopped:", err)
+		}()
+	}
+
+	log.Println("starting backfiller")
+	go func() {
+		err := backfiller.Serve(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Println("backfiller stopped:", err)
+		}
+	}()
+
+	changed, err := store.SetDefaultRouteSettings(ctx, config.Processor.BufferDistance, config.Processor.RelevanceTolerance)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if changed {
+		log.Println("default route settings changed, reprocessing affected routes")
+	}
+
 	log.Printf("starting %d processor(s)", config.Processor.Concurrency)
 	for i := 0; i < config.Processor.Concurrency; i++ {
-		processor := processor.New(store, handler.Received(), config.Processor.Interval, config.Processor.BatchSize)
+		processor := processor.New(store, handler.Received(), config.Processor.Interval, config.Processor.BatchSize, config.Processor.Lease, config.Processor.MaxAttempts)
 		go func() {
 			err = processor.Serve(ctx)
 			if err != nil {
@@ -89,3 +271,23 @@ func main() {
 
 	log.Fatal("shutting down")
 }
+
+func runCommand(command string, store *store.Store) {
+	ctx := context.Background()
+	switch command {
+	case "reencrypt-tokens":
+		n, err := store.ReencryptTokens(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("re-encrypted tokens for %d athlete(s)", n)
+	case "rebuild-route-stats":
+		n, err := store.RebuildRouteStats(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("rebuilt %d route stat(s)", n)
+	default:
+		log.Fatalf("unknown command %q", command)
+	}
+}
@@ -12,10 +12,14 @@ import (
 
 type Store interface {
 	Process(ctx context.Context) error
-	ProcessOne(ctx context.Context) error
-	ProcessBatch(ctx context.Context, batchSize int) (int, error)
+	ProcessOne(ctx context.Context, lease time.Duration, maxAttempts int) error
+	ProcessBatch(ctx context.Context, batchSize int, lease time.Duration, maxAttempts int) (int, error)
+	ReleaseExpiredClaims(ctx context.Context, lease time.Duration) (int, error)
 }
 
+// How many times per lease to check for expired claims.
+const reapsPerLease = 4
+
 type processorState int
 
 const (
@@ -29,19 +33,28 @@ type Processor struct {
 	interval  time.Duration
 	state     processorState
 	batchSize int
+	// How long a claim on a batch lasts. Must be longer than processing a
+	// batch takes, or another worker may process it too.
+	lease time.Duration
+	// How many times to try a pair that fails before dead-lettering it.
+	maxAttempts int
 }
 
-func New(store Store, trigger chan struct{}, interval time.Duration, batchSize int) *Processor {
+func New(store Store, trigger chan struct{}, interval time.Duration, batchSize int, lease time.Duration, maxAttempts int) *Processor {
 	return &Processor{
 		store:     store,
 		trigger:   trigger,
 		interval:  interval,
 		state:     idle,
 		batchSize: batchSize,
+		lease:     lease,
+
+		maxAttempts: maxAttempts,
 	}
 }
 
 func (p *Processor) Serve(ctx context.Context) error {
+	p.releaseExpiredClaims(ctx)
 	err := p.process(ctx, 0)
 	if err != nil {
 		return err
@@ -50,6 +63,15 @@ func (p *Processor) Serve(ctx context.Context) error {
 	ticker := time.NewTicker(p.interval)
 	defer ticker.Stop()
 
+	// Check for expired claims several times per lease, so pairs abandoned
+	// by a dead worker are released soon after their claim expires.
+	reapInterval := p.lease / reapsPerLease
+	if reapInterval <= 0 {
+		reapInterval = p.lease
+	}
+	reaper := time.NewTicker(reapInterval)
+	defer reaper.Stop()
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -71,17 +93,46 @@ func (p *Processor) Serve(ctx context.Context) error {
 			if err != nil {
 				return err
 			}
+
+		// Process pairs whose claim expired.
+		case <-reaper.C:
+			if p.releaseExpiredClaims(ctx) == 0 {
+				continue
+			}
+			err := p.process(ctx, 0)
+			if err != nil {
+				return err
+			}
 		}
 	}
 }
 
+// Releases claims that expired before their pairs were processed, returning
+// how many were released.
+func (p *Processor) releaseExpiredClaims(ctx context.Context) int {
+	n, err := p.store.ReleaseExpiredClaims(ctx, p.lease)
+	if err != nil {
+		log.Printf("processor: failed to release expired claims: %v", err)
+		return 0
+	}
+	if n > 0 {
+		log.Printf("processor: released %d expired claim(s)", n)
+	}
+	return n
+}
+
 // Check for unprocessed activities and process them.
+//
+// Pairs that fail to process are dealt with by the store. If processing fails
+// for any other reason, we give up until next time rather than returning an
+// error, so only a cancelled ctx stops the processor.
 func (p *Processor) process(ctx context.Context, recur int) error {
 	if p.state == processing {
 		log.Println("processor: already processing")
 		return nil
 	}
 	p.state = processing
+	defer func() { p.state = idle }()
 
 	processed := 0
 	log.Println("processor: processing")
@@ -89,24 +140,24 @@ func (p *Processor) process(ctx context.Context, recur int) error {
 
 	retries := 0
 	for p.state == processing {
-		n, err := p.store.ProcessBatch(ctx, p.batchSize)
+		n, err := p.store.ProcessBatch(ctx, p.batchSize, p.lease, p.maxAttempts)
 		if err != nil {
 			if errors.Is(err, store.ErrFinished) {
 				log.Println("processor: finished processing")
-				p.state = idle
 				return nil
 			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			var pgErr *pgconn.PgError
-			if errors.As(err, &pgErr) && (pgErr.Code == "40001" || pgErr.Code == "40P01") {
-				if retries > 3 {
-					return err
-				}
+			if errors.As(err, &pgErr) && (pgErr.Code == "40001" || pgErr.Code == "40P01") && retries <= 3 {
 				// Serialization error or deadlock - retry.
 				log.Printf("processor: serialization error (%s), retrying", pgErr.Code)
 				retries++
 				continue
 			}
-			return err
+			log.Printf("processor: failed to process batch, will try again later: %v", err)
+			return nil
 		}
 		processed += n
 	}
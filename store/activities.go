@@ -2,20 +2,61 @@ package store
 
 import (
 	"context"
+	"log"
 	"strconv"
 	"strings"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/kwoodhouse93/trail-progress-worker/strava"
+	"github.com/pkg/errors"
 )
 
-func (s Store) StoreActivity(ctx context.Context, athleteID int, activity strava.DetailedActivity) error {
+// Stores an activity, or updates it if we already have it. detailedTrack is
+// optional - if given, it's stored alongside the summary track and used in
+// preference to it when processing. Activities that have been deleted are not
+// stored again.
+//
+// eventTime is when the webhook event that prompted fetching the activity
+// happened, in seconds since the epoch. Existing activities are only updated
+// if it's not older than the last event applied to them. Pass 0 if there was
+// no event, e.g. when backfilling, to leave existing activities alone.
+//
+// If the activity's track or visibility has changed, its results are cleared
+// and it's queued to be processed again.
+func (s Store) StoreActivity(ctx context.Context, athleteID int, activity strava.DetailedActivity, detailedTrack []strava.LatLong, eventTime int) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var deleted bool
+	err = tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM deleted_activities WHERE id = $1)", activity.ID).Scan(&deleted)
+	if err != nil {
+		return err
+	}
+	if deleted {
+		log.Printf("store: activity %d has been deleted, not storing it", activity.ID)
+		return nil
+	}
+
+	oldInputs, err := activityProcessingInputs(ctx, tx, activity.ID, true)
+	if err != nil {
+		return err
+	}
+
 	var summaryTrack *string = nil
 	if activity.Map.SummaryPolyline != "" {
 		summaryTrack = &activity.Map.SummaryPolyline
 	}
-	_, err := s.pool.Exec(
+	var detailedTrackWKT *string = nil
+	if len(detailedTrack) >= 2 {
+		wkt := lineStringWKT(detailedTrack)
+		detailedTrackWKT = &wkt
+	}
+	_, err = tx.Exec(
 		ctx,
-		insertActivityQuery,
+		upsertActivityQuery,
 		activity.ID,
 		athleteID,
 		activity.Name,
@@ -34,14 +75,67 @@ func (s Store) StoreActivity(ctx context.Context, athleteID int, activity strava
 		activity.ElevHigh,
 		activity.ElevLow,
 		activity.ExternalID,
+		detailedTrackWKT,
+		eventTime,
+		activity.Private,
+		activity.HideFromHome,
 	)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	if oldInputs != nil {
+		newInputs, err := activityProcessingInputs(ctx, tx, activity.ID, false)
+		if err != nil {
+			return err
+		}
+		if *newInputs != *oldInputs {
+			log.Printf("store: track or visibility of activity %d has changed, queueing it to be processed again", activity.ID)
+			err = requeueActivity(ctx, tx, athleteID, activity.ID)
+			if err != nil {
+				return errors.Wrap(err, "store: failed to queue activity to be processed again")
+			}
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// The stored fields of an activity that affect the results of processing it.
+// Geometries are text so they can be compared exactly, and empty if the
+// activity doesn't have one.
+type processingInputs struct {
+	summaryTrack  string
+	detailedTrack string
+	private       bool
+	hideFromHome  bool
+}
+
+// Gets the activity's processing inputs, or nil if we don't have the activity.
+// Optionally locks the activity for the rest of the transaction.
+func activityProcessingInputs(ctx context.Context, tx pgx.Tx, activityID int, lock bool) (*processingInputs, error) {
+	query := `
+SELECT
+	COALESCE(summary_track::text, ''),
+	COALESCE(detailed_track::text, ''),
+	private,
+	hide_from_home
+FROM activities
+WHERE id = $1`
+	if lock {
+		query += " FOR UPDATE"
+	}
+	var t processingInputs
+	err := tx.QueryRow(ctx, query, activityID).Scan(&t.summaryTrack, &t.detailedTrack, &t.private, &t.hideFromHome)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &t, nil
 }
 
-const insertActivityQuery = `
+const upsertActivityQuery = `
 INSERT INTO activities (
 	id,
 	athlete_id,
@@ -58,7 +152,11 @@ INSERT INTO activities (
 	end_latlng,
 	elev_high,
 	elev_low,
-	external_id
+	external_id,
+	detailed_track,
+	last_event_time,
+	private,
+	hide_from_home
 ) VALUES (
 	$1,
 	$2,
@@ -75,47 +173,152 @@ INSERT INTO activities (
 	ST_Point($14, $15),
 	$16,
 	$17,
-	$18
-) ON CONFLICT DO NOTHING`
-
-func (s Store) UpdateActivity(ctx context.Context, athleteID, activityID int, title, activityType *string) error {
-	paramCount := 3
-	updates := []string{}
-	values := []interface{}{athleteID, activityID}
-	if title != nil {
-		updates = append(updates, "name = $"+strconv.Itoa(paramCount))
-		values = append(values, *title)
-		paramCount++
-	}
-	if activityType != nil {
-		updates = append(updates, "activity_type = $"+strconv.Itoa(paramCount))
-		values = append(values, *activityType)
-		paramCount++
-	}
-	if len(updates) == 0 {
-		return nil
+	$18,
+	ST_GeomFromText($19, 4326),
+	NULLIF($20::bigint, 0),
+	$21,
+	$22
+) ON CONFLICT (id) DO UPDATE SET
+	name = EXCLUDED.name,
+	distance = EXCLUDED.distance,
+	moving_time = EXCLUDED.moving_time,
+	elapsed_time = EXCLUDED.elapsed_time,
+	total_elevation_gain = EXCLUDED.total_elevation_gain,
+	activity_type = EXCLUDED.activity_type,
+	start_date = EXCLUDED.start_date,
+	local_tz = EXCLUDED.local_tz,
+	summary_track = EXCLUDED.summary_track,
+	start_latlng = EXCLUDED.start_latlng,
+	end_latlng = EXCLUDED.end_latlng,
+	elev_high = EXCLUDED.elev_high,
+	elev_low = EXCLUDED.elev_low,
+	external_id = EXCLUDED.external_id,
+	detailed_track = EXCLUDED.detailed_track,
+	last_event_time = EXCLUDED.last_event_time,
+	private = EXCLUDED.private,
+	hide_from_home = EXCLUDED.hide_from_home
+WHERE
+	EXCLUDED.last_event_time IS NOT NULL AND
+	(activities.last_event_time IS NULL OR activities.last_event_time <= EXCLUDED.last_event_time)`
+
+// Sets whether an activity is private, from an update event that happened at
+// eventTime, in seconds since the epoch. Used when we can't fetch the whole
+// activity, e.g. because it's become private and we can't see private
+// activities. If the flag changes, the activity is queued to be processed again.
+func (s Store) SetActivityPrivate(ctx context.Context, athleteID, activityID, eventTime int, private bool) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback(ctx)
 
-	query := "UPDATE activities SET " + strings.Join(updates, ", ") + " WHERE athlete_id = $1 AND id = $2"
-	_, err := s.pool.Exec(
-		ctx,
-		query,
-		values...,
-	)
+	tag, err := tx.Exec(ctx, setActivityPrivateQuery, athleteID, activityID, eventTime, private)
 	if err != nil {
 		return err
 	}
-	return nil
+	if tag.RowsAffected() > 0 {
+		log.Printf("store: visibility of activity %d has changed, queueing it to be processed again", activityID)
+		err = requeueActivity(ctx, tx, athleteID, activityID)
+		if err != nil {
+			return errors.Wrap(err, "store: failed to queue activity to be processed again")
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+const setActivityPrivateQuery = `
+UPDATE activities
+SET
+	private = $4,
+	last_event_time = $3
+WHERE
+	athlete_id = $1 AND
+	id = $2 AND
+	private <> $4 AND
+	(last_event_time IS NULL OR last_event_time <= $3)
+`
+
+// Clears the results of processing an activity, and queues it to be
+// processed again against every route, forgetting any previous failures.
+// Route stats for the athlete are recalculated without it straight away, so
+// they aren't left counting the old track in the meantime.
+func requeueActivity(ctx context.Context, tx pgx.Tx, athleteID, activityID int) error {
+	for _, query := range []string{
+		"DELETE FROM route_sections WHERE activity_id = $1",
+		"DELETE FROM intersections WHERE activity_id = $1",
+		"DELETE FROM relevant_activities WHERE activity_id = $1",
+		`UPDATE processing
+		SET
+			processed = false,
+			processing_started_at = NULL,
+			lease_expires_at = NULL,
+			attempts = 0,
+			last_error = NULL,
+			dead_lettered_at = NULL
+		WHERE activity_id = $1`,
+	} {
+		_, err := tx.Exec(ctx, query, activityID)
+		if err != nil {
+			return err
+		}
+	}
+	return updateAthleteRouteStats(ctx, tx, athleteID)
+}
+
+// Builds a WKT LINESTRING from Strava's [lat, lng] points. WKT uses (x y), i.e. (lng lat).
+func lineStringWKT(points []strava.LatLong) string {
+	var b strings.Builder
+	b.WriteString("LINESTRING(")
+	for i, p := range points {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(strconv.FormatFloat(p[1], 'f', -1, 64))
+		b.WriteString(" ")
+		b.WriteString(strconv.FormatFloat(p[0], 'f', -1, 64))
+	}
+	b.WriteString(")")
+	return b.String()
 }
 
-func (s Store) DeleteActivity(ctx context.Context, athleteID, activityID int) error {
-	_, err := s.pool.Exec(ctx, deleteActivityQuery, athleteID, activityID)
+// Deletes an activity, and remembers that it was deleted so it isn't stored
+// again by a late create event. The athlete's route stats are updated to
+// match. eventTime is when it was deleted, in seconds
+// since the epoch.
+func (s Store) DeleteActivity(ctx context.Context, athleteID, activityID, eventTime int) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, insertDeletedActivityQuery, activityID, athleteID, eventTime)
 	if err != nil {
 		return err
 	}
-	return nil
+	deleted, err := tx.Exec(ctx, deleteActivityQuery, athleteID, activityID)
+	if err != nil {
+		return err
+	}
+	// Processing only updates stats for the pairs it processes, so take the
+	// activity's sections out of the athlete's stats now.
+	if deleted.RowsAffected() > 0 {
+		err = updateAthleteRouteStats(ctx, tx, athleteID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
 }
 
+// Nothing to remember if the athlete has already been deleted.
+const insertDeletedActivityQuery = `
+INSERT INTO deleted_activities (id, athlete_id, event_time)
+SELECT $1::bigint, $2::bigint, $3::bigint
+WHERE EXISTS (SELECT 1 FROM athletes WHERE id = $2)
+ON CONFLICT (id) DO UPDATE SET event_time = GREATEST(deleted_activities.event_time, EXCLUDED.event_time)
+`
+
 const deleteActivityQuery = `
 DELETE FROM activities
 WHERE athlete_id = $1
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"context"
+	"hash/fnv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// AdvisoryLock is a session level Postgres advisory lock. It's held on its
+// own connection, outside the pool, so holding it doesn't take a connection
+// other work needs. It's released if that connection is lost, e.g. because
+// the process holding it died.
+type AdvisoryLock struct {
+	conn *pgx.Conn
+	key  int64
+}
+
+// AdvisoryLockKey derives a lock key from a name, so callers locking the same
+// thing agree on the key.
+func AdvisoryLockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+// Takes the advisory lock with the given key, if no one else holds it, on a
+// new connection. Returns nil if someone else does.
+func (s Store) TryAdvisoryLock(ctx context.Context, key int64) (*AdvisoryLock, error) {
+	conn, err := pgx.ConnectConfig(ctx, s.pool.Config().ConnConfig.Copy())
+	if err != nil {
+		return nil, err
+	}
+
+	var locked bool
+	err = conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&locked)
+	if err != nil || !locked {
+		closeConn(conn)
+		return nil, err
+	}
+	return &AdvisoryLock{conn: conn, key: key}, nil
+}
+
+// Check returns an error if the lock may have been lost, because the
+// connection holding it is broken.
+func (l *AdvisoryLock) Check(ctx context.Context) error {
+	return l.conn.Ping(ctx)
+}
+
+// Release releases the lock and closes its connection.
+func (l *AdvisoryLock) Release(ctx context.Context) error {
+	// Closing the connection releases the lock anyway, but unlock first so
+	// we find out if that failed.
+	_, err := l.conn.Exec(ctx, "SELECT pg_advisory_unlock($1)", l.key)
+	closeConn(l.conn)
+	return err
+}
+
+func closeConn(conn *pgx.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn.Close(ctx)
+}
@@ -1,6 +1,114 @@
 package store
 
-import "context"
+import (
+	"context"
+	"time"
+)
+
+// Creates an athlete who has just authorized us, storing their tokens and
+// the scopes they granted. If the athlete already exists, e.g. because
+// they've re-authorized, their tokens and scopes are replaced.
+func (s Store) CreateAthlete(ctx context.Context, athleteID int, accessToken, refreshToken string, expiresAt time.Time, scopes []string) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	accessToken, err = s.keyring.encrypt(accessToken, accessTokenAAD(athleteID))
+	if err != nil {
+		return err
+	}
+	refreshToken, err = s.keyring.encrypt(refreshToken, refreshTokenAAD(athleteID))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, createAthleteQuery, athleteID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, upsertAccessTokenQuery, athleteID, accessToken, expiresAt, scopes)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, upsertRefreshTokenQuery, athleteID, refreshToken)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Re-authorizing clears any previous need for reauthorization.
+const createAthleteQuery = `
+INSERT INTO athletes (id)
+VALUES ($1)
+ON CONFLICT (id) DO UPDATE
+SET
+	needs_reauthorization_at = NULL,
+	reauthorization_reason = NULL
+`
+
+const upsertAccessTokenQuery = `
+INSERT INTO access_tokens (athlete_id, access_token, expires_at, scopes)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (athlete_id) DO UPDATE
+SET
+	access_token = EXCLUDED.access_token,
+	expires_at = EXCLUDED.expires_at,
+	scopes = EXCLUDED.scopes
+`
+
+const upsertRefreshTokenQuery = `
+INSERT INTO refresh_tokens (athlete_id, refresh_token)
+VALUES ($1, $2)
+ON CONFLICT (athlete_id) DO UPDATE
+SET refresh_token = EXCLUDED.refresh_token
+`
+
+// Records that we can't do what we need to for the athlete until they
+// authorize us again, e.g. because they didn't grant a scope we need.
+func (s Store) SetNeedsReauthorization(ctx context.Context, athleteID int, reason string) error {
+	_, err := s.pool.Exec(ctx, setNeedsReauthorizationQuery, athleteID, reason)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+const setNeedsReauthorizationQuery = `
+UPDATE athletes
+SET
+	needs_reauthorization_at = COALESCE(needs_reauthorization_at, NOW()),
+	reauthorization_reason = $2
+WHERE id = $1
+`
+
+// Records that the athlete has revoked our access, e.g. because Strava rejected
+// their refresh token. Their tokens are deleted, so we stop calling Strava for
+// them, but their data is kept. Authorizing us again restores their tokens.
+func (s Store) SetDeauthorized(ctx context.Context, athleteID int, reason string) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, setNeedsReauthorizationQuery, athleteID, reason)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, "DELETE FROM access_tokens WHERE athlete_id = $1", athleteID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, "DELETE FROM refresh_tokens WHERE athlete_id = $1", athleteID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
 
 func (s Store) DeleteAthlete(ctx context.Context, athleteID int) error {
 	_, err := s.pool.Exec(ctx, deleteAthleteQuery, athleteID)
@@ -0,0 +1,119 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pkg/errors"
+)
+
+// BackfillCursor records how far through an athlete's activity history we've imported.
+type BackfillCursor struct {
+	// Start time of the most recent activity imported so far.
+	After       time.Time
+	CompletedAt *time.Time
+}
+
+// Returns a zero cursor if no backfill has been started for the athlete.
+func (s Store) GetBackfillCursor(ctx context.Context, athleteID int) (*BackfillCursor, error) {
+	row := s.pool.QueryRow(ctx, "SELECT after, completed_at FROM backfill_cursors WHERE athlete_id = $1", athleteID)
+
+	var cursor BackfillCursor
+	err := row.Scan(&cursor.After, &cursor.CompletedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return &BackfillCursor{}, nil
+		}
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+// Creates a cursor for the athlete if one doesn't exist, or marks an existing
+// one incomplete, so their backfill will be resumed after a restart.
+func (s Store) StartBackfill(ctx context.Context, athleteID int) error {
+	_, err := s.pool.Exec(ctx, startBackfillQuery, athleteID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+const startBackfillQuery = `
+INSERT INTO backfill_cursors (athlete_id)
+VALUES ($1)
+ON CONFLICT (athlete_id) DO UPDATE
+SET
+	completed_at = NULL,
+	updated_at = NOW()
+`
+
+func (s Store) SaveBackfillCursor(ctx context.Context, athleteID int, after time.Time, completed bool) error {
+	_, err := s.pool.Exec(ctx, saveBackfillCursorQuery, athleteID, after, completed)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+const saveBackfillCursorQuery = `
+INSERT INTO backfill_cursors (athlete_id, after, completed_at, updated_at)
+VALUES ($1, $2, CASE WHEN $3 THEN NOW() END, NOW())
+ON CONFLICT (athlete_id) DO UPDATE
+SET
+	after = EXCLUDED.after,
+	completed_at = EXCLUDED.completed_at,
+	updated_at = EXCLUDED.updated_at
+`
+
+// Returns the athletes whose backfill was started but hasn't completed.
+func (s Store) IncompleteBackfills(ctx context.Context) ([]int, error) {
+	rows, err := s.pool.Query(ctx, "SELECT athlete_id FROM backfill_cursors WHERE completed_at IS NULL ORDER BY updated_at ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	athleteIDs := []int{}
+	for rows.Next() {
+		var athleteID int
+		err = rows.Scan(&athleteID)
+		if err != nil {
+			return nil, err
+		}
+		athleteIDs = append(athleteIDs, athleteID)
+	}
+	return athleteIDs, rows.Err()
+}
+
+// ClaimBackfill claims the athlete's backfill for owner until lease from now,
+// unless another owner's claim hasn't expired yet. Owners renew their claim
+// by claiming it again. Returns whether owner holds the claim.
+func (s Store) ClaimBackfill(ctx context.Context, athleteID int, owner string, lease time.Duration) (bool, error) {
+	n, err := s.pool.Exec(ctx, claimBackfillQuery, athleteID, owner, lease)
+	if err != nil {
+		return false, err
+	}
+	return n.RowsAffected() > 0, nil
+}
+
+const claimBackfillQuery = `
+UPDATE backfill_cursors
+SET
+	claimed_by = $2,
+	claimed_until = NOW() + $3::interval
+WHERE
+	athlete_id = $1 AND
+	(claimed_by IS NULL OR claimed_by = $2 OR claimed_until < NOW())
+`
+
+// ReleaseBackfill releases owner's claim on the athlete's backfill, if it
+// still holds it.
+func (s Store) ReleaseBackfill(ctx context.Context, athleteID int, owner string) error {
+	_, err := s.pool.Exec(ctx, "UPDATE backfill_cursors SET claimed_by = NULL, claimed_until = NULL WHERE athlete_id = $1 AND claimed_by = $2", athleteID, owner)
+	if err != nil {
+		return err
+	}
+	return nil
+}
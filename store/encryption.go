@@ -0,0 +1,176 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Encrypted values are stored as "enc:{key ID}:{wrapped data key}:{ciphertext}".
+// Values without the prefix are plaintext, written before encryption was enabled.
+const encryptedPrefix = "enc:"
+
+// Keyring encrypts tokens at rest using envelope encryption. Each value is
+// encrypted with a fresh AES-256-GCM data key, which is itself encrypted
+// ("wrapped") with a key encryption key identified by its ID.
+//
+// New values are always wrapped with the current key. Old keys are kept so
+// values wrapped with them can still be read until they're re-encrypted.
+type Keyring struct {
+	currentKeyID string
+	keys         map[string]cipher.AEAD
+}
+
+// ParseKeys parses keys given as "id1:base64key1,id2:base64key2".
+// Keys must be 32 bytes, for AES-256.
+func ParseKeys(spec string) (map[string][]byte, error) {
+	keys := map[string][]byte{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("store: encryption keys must be given as id:base64key")
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "store: failed to decode encryption key %q", parts[0])
+		}
+		keys[parts[0]] = key
+	}
+	return keys, nil
+}
+
+func NewKeyring(currentKeyID string, keys map[string][]byte) (*Keyring, error) {
+	k := &Keyring{
+		currentKeyID: currentKeyID,
+		keys:         map[string]cipher.AEAD{},
+	}
+	for id, key := range keys {
+		if strings.Contains(id, ":") {
+			return nil, errors.Errorf("store: encryption key ID %q must not contain ':'", id)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "store: invalid encryption key %q", id)
+		}
+		k.keys[id] = aead
+	}
+	if _, ok := k.keys[currentKeyID]; !ok {
+		return nil, errors.Errorf("store: current encryption key %q not found", currentKeyID)
+	}
+	return k, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("key must be 32 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// aad binds a value to where it's stored, e.g. "access_token:123", so it
+// can't be copied to another athlete or column and still decrypt.
+func (k *Keyring) encrypt(plaintext, aad string) (string, error) {
+	if k == nil {
+		return plaintext, nil
+	}
+
+	dataKey := make([]byte, 32)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return "", err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(dataAEAD, []byte(plaintext), []byte(aad))
+	if err != nil {
+		return "", err
+	}
+	wrappedKey, err := seal(k.keys[k.currentKeyID], dataKey, []byte(aad))
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedPrefix + k.currentKeyID + ":" +
+		base64.RawStdEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.RawStdEncoding.EncodeToString(ciphertext), nil
+}
+
+func (k *Keyring) decrypt(value, aad string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	if k == nil {
+		return "", errors.New("store: found encrypted value but no encryption keys are configured")
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if len(parts) != 3 {
+		return "", errors.New("store: malformed encrypted value")
+	}
+	keyAEAD, ok := k.keys[parts[0]]
+	if !ok {
+		return "", errors.Errorf("store: encryption key %q not found", parts[0])
+	}
+	wrappedKey, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.Wrap(err, "store: malformed encrypted value")
+	}
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.Wrap(err, "store: malformed encrypted value")
+	}
+
+	dataKey, err := open(keyAEAD, wrappedKey, []byte(aad))
+	if err != nil {
+		return "", errors.Wrap(err, "store: failed to unwrap data key")
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(dataAEAD, ciphertext, []byte(aad))
+	if err != nil {
+		return "", errors.Wrap(err, "store: failed to decrypt value")
+	}
+	return string(plaintext), nil
+}
+
+// needsReencryption reports whether value isn't encrypted with the current key.
+func (k *Keyring) needsReencryption(value string) bool {
+	if k == nil {
+		return false
+	}
+	return !strings.HasPrefix(value, encryptedPrefix+k.currentKeyID+":")
+}
+
+// seal prepends the random nonce to the ciphertext.
+func seal(aead cipher.AEAD, plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(aead cipher.AEAD, sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, aad)
+}
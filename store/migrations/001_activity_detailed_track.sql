@@ -0,0 +1,4 @@
+-- Full resolution GPS track fetched from the activity's latlng stream.
+-- Used in preference to summary_track when calculating intersections.
+ALTER TABLE activities
+	ADD COLUMN detailed_track geography(LineString, 4326);
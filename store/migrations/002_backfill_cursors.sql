@@ -0,0 +1,8 @@
+-- Resumable cursor for importing an athlete's activity history.
+-- Insert a row to (re)start a backfill for an athlete.
+CREATE TABLE backfill_cursors (
+	athlete_id bigint PRIMARY KEY REFERENCES athletes(id) ON DELETE CASCADE,
+	after timestamptz NOT NULL DEFAULT 'epoch',
+	completed_at timestamptz,
+	updated_at timestamptz NOT NULL DEFAULT NOW()
+);
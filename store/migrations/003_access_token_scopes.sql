@@ -0,0 +1,4 @@
+-- Scopes granted by the athlete when they authorized us, e.g. {read,activity:read_all}.
+-- NULL for tokens created before scopes were recorded.
+ALTER TABLE access_tokens
+	ADD COLUMN scopes text[];
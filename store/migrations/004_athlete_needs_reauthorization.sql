@@ -0,0 +1,5 @@
+-- Set when we can't act for the athlete until they authorize us again,
+-- e.g. because they didn't grant activity:read_all. Cleared when they do.
+ALTER TABLE athletes
+	ADD COLUMN needs_reauthorization_at timestamptz,
+	ADD COLUMN reauthorization_reason text;
@@ -0,0 +1,16 @@
+-- Inbox of raw webhook events from Strava, processed asynchronously so we can
+-- acknowledge them immediately.
+CREATE TABLE webhook_events (
+	id bigserial PRIMARY KEY,
+	payload jsonb NOT NULL,
+	-- pending, processing, done or failed
+	status text NOT NULL DEFAULT 'pending',
+	attempts int NOT NULL DEFAULT 0,
+	last_error text,
+	next_attempt_at timestamptz NOT NULL DEFAULT NOW(),
+	received_at timestamptz NOT NULL DEFAULT NOW(),
+	updated_at timestamptz NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX webhook_events_due_idx ON webhook_events (next_attempt_at)
+	WHERE status IN ('pending', 'processing');
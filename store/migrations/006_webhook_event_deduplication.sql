@@ -0,0 +1,48 @@
+-- Strava may deliver the same event more than once. Events are identified by
+-- what they're about and when they happened, so duplicates can be dropped.
+ALTER TABLE webhook_events
+	ADD COLUMN object_type text,
+	ADD COLUMN object_id bigint,
+	ADD COLUMN aspect_type text,
+	ADD COLUMN event_time bigint;
+
+UPDATE webhook_events SET
+	object_type = payload->>'object_type',
+	object_id = (payload->>'object_id')::bigint,
+	aspect_type = payload->>'aspect_type',
+	event_time = (payload->>'event_time')::bigint;
+
+DELETE FROM webhook_events AS e
+USING webhook_events AS earlier
+WHERE
+	earlier.object_type = e.object_type AND
+	earlier.object_id = e.object_id AND
+	earlier.aspect_type = e.aspect_type AND
+	earlier.event_time = e.event_time AND
+	earlier.id < e.id;
+
+ALTER TABLE webhook_events
+	ALTER COLUMN object_type SET NOT NULL,
+	ALTER COLUMN object_id SET NOT NULL,
+	ALTER COLUMN aspect_type SET NOT NULL,
+	ALTER COLUMN event_time SET NOT NULL;
+
+CREATE UNIQUE INDEX webhook_events_dedup_idx
+	ON webhook_events (object_type, object_id, aspect_type, event_time);
+
+-- Events for the same object are processed in order.
+CREATE INDEX webhook_events_object_idx ON webhook_events (object_type, object_id, event_time)
+	WHERE status IN ('pending', 'processing');
+
+-- Time of the latest update event applied to the activity, in seconds since
+-- the epoch. Older update events are ignored.
+ALTER TABLE activities ADD COLUMN last_event_time bigint;
+
+-- Activities deleted by their athlete, so a late or replayed create event
+-- doesn't bring them back.
+CREATE TABLE deleted_activities (
+	id bigint PRIMARY KEY,
+	athlete_id bigint NOT NULL REFERENCES athletes(id) ON DELETE CASCADE,
+	event_time bigint NOT NULL,
+	deleted_at timestamptz NOT NULL DEFAULT NOW()
+);
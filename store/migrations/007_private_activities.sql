@@ -0,0 +1,57 @@
+-- Visibility of activities on Strava. Activities stored before this was
+-- recorded are assumed to be public until they're next updated.
+ALTER TABLE activities
+	ADD COLUMN private boolean NOT NULL DEFAULT false,
+	ADD COLUMN hide_from_home boolean NOT NULL DEFAULT false;
+
+-- Whether the athlete's private and hidden activities count towards their
+-- progress. Excluded activities are marked as processed without producing
+-- any intersections or route sections.
+ALTER TABLE athletes
+	ADD COLUMN count_private_activities boolean NOT NULL DEFAULT true;
+
+-- When the preference changes, clear the results for the athlete's private
+-- and hidden activities and queue them to be processed again. Route stats are
+-- recalculated without them straight away, and again as they're processed.
+CREATE FUNCTION requeue_private_activities() RETURNS trigger AS $$
+BEGIN
+	DELETE FROM route_sections WHERE activity_id IN (
+		SELECT id FROM activities WHERE athlete_id = NEW.id AND (private OR hide_from_home)
+	);
+	DELETE FROM intersections WHERE activity_id IN (
+		SELECT id FROM activities WHERE athlete_id = NEW.id AND (private OR hide_from_home)
+	);
+	DELETE FROM relevant_activities WHERE activity_id IN (
+		SELECT id FROM activities WHERE athlete_id = NEW.id AND (private OR hide_from_home)
+	);
+	UPDATE processing SET processed = false, processing_started_at = NULL
+	WHERE activity_id IN (
+		SELECT id FROM activities WHERE athlete_id = NEW.id AND (private OR hide_from_home)
+	);
+
+	WITH rs AS (
+		SELECT route_sections.section_track, route_sections.route_id
+		FROM route_sections
+		JOIN activities ON activities.id = route_sections.activity_id
+		WHERE activities.athlete_id = NEW.id
+	)
+	INSERT INTO route_stats (route_id, athlete_id, covered_length)
+	SELECT
+		routes.id,
+		NEW.id,
+		COALESCE(ST_Length(ST_Union(rs.section_track::geometry)::geography), 0)
+	FROM routes
+	LEFT OUTER JOIN rs ON rs.route_id = routes.id
+	GROUP BY routes.id
+	ON CONFLICT (athlete_id, route_id) DO UPDATE
+	SET covered_length = EXCLUDED.covered_length;
+
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER athletes_count_private_activities_changed
+	AFTER UPDATE OF count_private_activities ON athletes
+	FOR EACH ROW
+	WHEN (OLD.count_private_activities IS DISTINCT FROM NEW.count_private_activities)
+	EXECUTE FUNCTION requeue_private_activities();
@@ -0,0 +1,12 @@
+-- Our Strava push subscription, shared by every instance of the worker so
+-- they can reuse it rather than each creating their own. Keyed by callback
+-- URL (without any secret), so e.g. staging and production can share a database.
+CREATE TABLE webhook_subscriptions (
+	callback_url text PRIMARY KEY,
+	-- Strava sends this back when validating a new subscription.
+	verify_token text NOT NULL,
+	-- NULL until the subscription has been created.
+	subscription_id bigint,
+	created_at timestamptz NOT NULL DEFAULT NOW(),
+	updated_at timestamptz NOT NULL DEFAULT NOW()
+);
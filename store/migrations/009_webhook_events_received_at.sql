@@ -0,0 +1,2 @@
+-- For finding when we last received a webhook event.
+CREATE INDEX webhook_events_received_at_idx ON webhook_events (received_at);
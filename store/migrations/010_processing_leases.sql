@@ -0,0 +1,7 @@
+-- When a worker's claim on an activity/route pair expires. If the pair hasn't
+-- been processed by then, the worker is assumed to have died and the pair is
+-- released to be processed again.
+ALTER TABLE processing ADD COLUMN lease_expires_at timestamptz;
+
+CREATE INDEX processing_claimed_idx ON processing (lease_expires_at)
+	WHERE processed = false AND processing_started_at IS NOT NULL;
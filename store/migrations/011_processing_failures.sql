@@ -0,0 +1,55 @@
+-- Failed attempts to process an activity/route pair, e.g. because of bad
+-- geometry. After too many, the pair is dead-lettered: it keeps its claim, so
+-- it isn't processed again until someone resets it.
+ALTER TABLE processing
+	ADD COLUMN attempts int NOT NULL DEFAULT 0,
+	ADD COLUMN last_error text,
+	ADD COLUMN dead_lettered_at timestamptz;
+
+CREATE INDEX processing_dead_lettered_idx ON processing (dead_lettered_at)
+	WHERE dead_lettered_at IS NOT NULL;
+
+-- Requeued pairs start again from scratch, since the inputs have changed.
+CREATE OR REPLACE FUNCTION requeue_private_activities() RETURNS trigger AS $$
+BEGIN
+	DELETE FROM route_sections WHERE activity_id IN (
+		SELECT id FROM activities WHERE athlete_id = NEW.id AND (private OR hide_from_home)
+	);
+	DELETE FROM intersections WHERE activity_id IN (
+		SELECT id FROM activities WHERE athlete_id = NEW.id AND (private OR hide_from_home)
+	);
+	DELETE FROM relevant_activities WHERE activity_id IN (
+		SELECT id FROM activities WHERE athlete_id = NEW.id AND (private OR hide_from_home)
+	);
+	UPDATE processing
+	SET
+		processed = false,
+		processing_started_at = NULL,
+		lease_expires_at = NULL,
+		attempts = 0,
+		last_error = NULL,
+		dead_lettered_at = NULL
+	WHERE activity_id IN (
+		SELECT id FROM activities WHERE athlete_id = NEW.id AND (private OR hide_from_home)
+	);
+
+	WITH rs AS (
+		SELECT route_sections.section_track, route_sections.route_id
+		FROM route_sections
+		JOIN activities ON activities.id = route_sections.activity_id
+		WHERE activities.athlete_id = NEW.id
+	)
+	INSERT INTO route_stats (route_id, athlete_id, covered_length)
+	SELECT
+		routes.id,
+		NEW.id,
+		COALESCE(ST_Length(ST_Union(rs.section_track::geometry)::geography), 0)
+	FROM routes
+	LEFT OUTER JOIN rs ON rs.route_id = routes.id
+	GROUP BY routes.id
+	ON CONFLICT (athlete_id, route_id) DO UPDATE
+	SET covered_length = EXCLUDED.covered_length;
+
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,27 @@
+-- Route geometries used when processing, cached so they aren't recalculated
+-- for every activity/route pair. Kept up to date by the trigger below
+-- whenever a route's track changes.
+ALTER TABLE routes
+	-- Simplified track, for quickly checking whether an activity is near the route.
+	ADD COLUMN simplified_track geography,
+	-- Track buffered by the distance an activity may stray from the route.
+	ADD COLUMN buffered_track geography;
+
+CREATE FUNCTION refresh_route_geometries() RETURNS trigger AS $$
+BEGIN
+	NEW.simplified_track := ST_Simplify(NEW.track::geometry, 0.001)::geography;
+	NEW.buffered_track := ST_Buffer(NEW.track, 200);
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER routes_refresh_geometries
+	BEFORE INSERT OR UPDATE OF track ON routes
+	FOR EACH ROW
+	EXECUTE FUNCTION refresh_route_geometries();
+
+-- Fill in the cache for existing routes.
+UPDATE routes SET track = track;
+
+CREATE INDEX routes_simplified_track_idx ON routes USING GIST (simplified_track);
+CREATE INDEX routes_buffered_track_idx ON routes USING GIST (buffered_track);
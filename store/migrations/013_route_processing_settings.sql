@@ -0,0 +1,99 @@
+-- Defaults for routes that don't set their own processing settings. The worker
+-- sets these from PROCESSOR_BUFFER_DISTANCE and PROCESSOR_RELEVANCE_TOLERANCE
+-- when it starts. Only ever has one row.
+CREATE TABLE route_setting_defaults (
+	id boolean PRIMARY KEY DEFAULT true CHECK (id),
+	-- Metres an activity may stray from a route and still count towards it.
+	buffer_distance double precision NOT NULL CHECK (buffer_distance > 0),
+	-- Degrees tracks are simplified by when checking whether an activity is near a route.
+	relevance_tolerance double precision NOT NULL CHECK (relevance_tolerance >= 0)
+);
+
+INSERT INTO route_setting_defaults (buffer_distance, relevance_tolerance) VALUES (200, 0.001);
+
+ALTER TABLE routes
+	-- Per route overrides. NULL to use the defaults.
+	ADD COLUMN buffer_distance double precision CHECK (buffer_distance > 0),
+	ADD COLUMN relevance_tolerance double precision CHECK (relevance_tolerance >= 0),
+	-- The settings the cached geometries were calculated with.
+	ADD COLUMN effective_buffer_distance double precision,
+	ADD COLUMN effective_relevance_tolerance double precision;
+
+-- The settings that produced each result.
+ALTER TABLE relevant_activities
+	ADD COLUMN buffer_distance double precision,
+	ADD COLUMN relevance_tolerance double precision;
+
+ALTER TABLE intersections
+	ADD COLUMN buffer_distance double precision;
+
+CREATE OR REPLACE FUNCTION refresh_route_geometries() RETURNS trigger AS $$
+DECLARE
+	defaults route_setting_defaults;
+BEGIN
+	SELECT * INTO defaults FROM route_setting_defaults;
+	NEW.effective_buffer_distance := COALESCE(NEW.buffer_distance, defaults.buffer_distance);
+	NEW.effective_relevance_tolerance := COALESCE(NEW.relevance_tolerance, defaults.relevance_tolerance);
+	NEW.simplified_track := ST_Simplify(NEW.track::geometry, NEW.effective_relevance_tolerance)::geography;
+	NEW.buffered_track := ST_Buffer(NEW.track, NEW.effective_buffer_distance);
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER routes_refresh_geometries ON routes;
+CREATE TRIGGER routes_refresh_geometries
+	BEFORE INSERT OR UPDATE OF track, buffer_distance, relevance_tolerance ON routes
+	FOR EACH ROW
+	EXECUTE FUNCTION refresh_route_geometries();
+
+-- Record the settings used for existing routes and results. They were all
+-- calculated with the defaults above, so nothing needs reprocessing.
+UPDATE routes SET track = track;
+UPDATE relevant_activities SET buffer_distance = 200, relevance_tolerance = 0.001;
+UPDATE intersections SET buffer_distance = 200;
+
+-- Results calculated with the old settings are out of date, so start the
+-- route's pairs again from scratch. Its stats are recalculated as they're
+-- processed.
+CREATE FUNCTION requeue_route() RETURNS trigger AS $$
+BEGIN
+	DELETE FROM route_sections WHERE route_id = NEW.id;
+	DELETE FROM intersections WHERE route_id = NEW.id;
+	DELETE FROM relevant_activities WHERE route_id = NEW.id;
+	UPDATE processing
+	SET
+		processed = false,
+		processing_started_at = NULL,
+		lease_expires_at = NULL,
+		attempts = 0,
+		last_error = NULL,
+		dead_lettered_at = NULL
+	WHERE route_id = NEW.id;
+	UPDATE route_stats SET covered_length = 0 WHERE route_id = NEW.id;
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER routes_settings_changed
+	AFTER UPDATE ON routes
+	FOR EACH ROW
+	WHEN (
+		OLD.effective_buffer_distance IS DISTINCT FROM NEW.effective_buffer_distance OR
+		OLD.effective_relevance_tolerance IS DISTINCT FROM NEW.effective_relevance_tolerance
+	)
+	EXECUTE FUNCTION requeue_route();
+
+-- Recalculate routes using the defaults when they change.
+CREATE FUNCTION refresh_default_route_geometries() RETURNS trigger AS $$
+BEGIN
+	UPDATE routes SET track = track
+	WHERE buffer_distance IS NULL OR relevance_tolerance IS NULL;
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER route_setting_defaults_changed
+	AFTER UPDATE ON route_setting_defaults
+	FOR EACH ROW
+	WHEN (OLD IS DISTINCT FROM NEW)
+	EXECUTE FUNCTION refresh_default_route_geometries();
@@ -0,0 +1,56 @@
+-- Route stats are recalculated from all of an athlete's sections for a route,
+-- so transactions recalculating them for the same athlete and route take
+-- turns, using advisory locks keyed by
+-- hashtextextended('route_stats:{athlete_id}:{route_id}', 0), taken in order.
+CREATE OR REPLACE FUNCTION requeue_private_activities() RETURNS trigger AS $$
+BEGIN
+	DELETE FROM route_sections WHERE activity_id IN (
+		SELECT id FROM activities WHERE athlete_id = NEW.id AND (private OR hide_from_home)
+	);
+	DELETE FROM intersections WHERE activity_id IN (
+		SELECT id FROM activities WHERE athlete_id = NEW.id AND (private OR hide_from_home)
+	);
+	DELETE FROM relevant_activities WHERE activity_id IN (
+		SELECT id FROM activities WHERE athlete_id = NEW.id AND (private OR hide_from_home)
+	);
+	UPDATE processing
+	SET
+		processed = false,
+		processing_started_at = NULL,
+		lease_expires_at = NULL,
+		attempts = 0,
+		last_error = NULL,
+		dead_lettered_at = NULL
+	WHERE activity_id IN (
+		SELECT id FROM activities WHERE athlete_id = NEW.id AND (private OR hide_from_home)
+	);
+
+	-- Take the same locks as processing before recalculating stats, so
+	-- neither overwrites the other with a total missing the other's sections.
+	PERFORM pg_advisory_xact_lock(lock_key)
+	FROM (
+		SELECT hashtextextended('route_stats:' || NEW.id || ':' || routes.id, 0) AS lock_key
+		FROM routes
+		ORDER BY lock_key
+	) AS keys;
+
+	WITH rs AS (
+		SELECT route_sections.section_track, route_sections.route_id
+		FROM route_sections
+		JOIN activities ON activities.id = route_sections.activity_id
+		WHERE activities.athlete_id = NEW.id
+	)
+	INSERT INTO route_stats (route_id, athlete_id, covered_length)
+	SELECT
+		routes.id,
+		NEW.id,
+		COALESCE(ST_Length(ST_Union(rs.section_track::geometry)::geography), 0)
+	FROM routes
+	LEFT OUTER JOIN rs ON rs.route_id = routes.id
+	GROUP BY routes.id
+	ON CONFLICT (athlete_id, route_id) DO UPDATE
+	SET covered_length = EXCLUDED.covered_length;
+
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
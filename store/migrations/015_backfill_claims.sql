@@ -0,0 +1,7 @@
+-- Which instance is running an athlete's backfill, so two instances don't
+-- import the same history at once. The claim is renewed while the backfill
+-- runs, including while it waits for rate limits, and lapses if the instance
+-- dies.
+ALTER TABLE backfill_cursors
+	ADD COLUMN claimed_by text,
+	ADD COLUMN claimed_until timestamptz;
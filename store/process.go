@@ -56,7 +56,7 @@ func (s Store) Process(ctx context.Context) error {
 		return errors.Wrap(err, "store: error executing process null maps")
 	}
 	totalProcessed += int(n.RowsAffected())
-	log.Printf("store: marked as processed %d activity/route pairs with null maps\n", n.RowsAffected())
+	log.Printf("store: marked as processed %d activity/route pairs with null maps or excluded activities\n", n.RowsAffected())
 
 	n, err = tx.Exec(ctx, populateRelevantActivities)
 	if err != nil {
@@ -0,0 +1,57 @@
+package store
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Workers claim activity/route pairs by setting processing_started_at, and
+// hold the claim until lease_expires_at. Pairs are released (both unset) if
+// processing fails, or by ReleaseExpiredClaims if the lease expires first.
+
+// ReleaseExpiredClaims makes pairs whose claim has expired without them being
+// processed available to process again, e.g. because the worker processing
+// them died, or because processing them failed. Dead-lettered pairs are left
+// alone. Pairs claimed before leases were recorded are released once lease
+// has passed since they were claimed. Returns the number released.
+func (s Store) ReleaseExpiredClaims(ctx context.Context, lease time.Duration) (int, error) {
+	n, err := s.pool.Exec(ctx, releaseExpiredClaimsQuery, lease)
+	if err != nil {
+		return 0, err
+	}
+	return int(n.RowsAffected()), nil
+}
+
+const releaseExpiredClaimsQuery = `
+UPDATE processing
+SET
+	processing_started_at = NULL,
+	lease_expires_at = NULL
+WHERE
+	processed = false AND
+	dead_lettered_at IS NULL AND
+	processing_started_at IS NOT NULL AND
+	COALESCE(lease_expires_at, processing_started_at + $1::interval) < NOW()
+`
+
+// Releases our claim on pairs we failed to process, so they can be processed
+// again without waiting for the lease to expire. Runs even if ctx is done,
+// since that's a common reason for failing.
+func (s Store) releaseClaims(ids []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := s.pool.Exec(ctx, releaseClaimsQuery, ids)
+	if err != nil {
+		log.Printf("store: failed to release claim on %d pair(s), they'll be released when the lease expires: %v", len(ids), err)
+	}
+}
+
+const releaseClaimsQuery = `
+UPDATE processing
+SET
+	processing_started_at = NULL,
+	lease_expires_at = NULL
+WHERE id = ANY($1) AND processed = false
+`
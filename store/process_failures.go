@@ -0,0 +1,53 @@
+package store
+
+import (
+	"context"
+	"log"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+)
+
+// Reports whether err was caused by the data being processed, e.g. an
+// activity with geometry PostGIS can't handle, rather than e.g. a lost
+// connection or a conflict with another transaction. PostGIS reports
+// geometry errors as internal errors.
+func isPairError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	class := pgErr.Code[:2]
+	return class == "22" || class == "XX"
+}
+
+// Records a failed attempt to process a pair. The pair keeps its claim, so
+// it's retried once the lease expires, unless it has now failed maxAttempts
+// times, in which case it's dead-lettered. Uses the connection we processed
+// the pair on, rather than waiting for another from the pool.
+func recordFailure(ctx context.Context, conn *pgxpool.Conn, p processable, cause error, maxAttempts int) error {
+	row := conn.QueryRow(ctx, recordFailureQuery, p.ID, cause.Error(), maxAttempts)
+	var attempts int
+	var deadLettered bool
+	err := row.Scan(&attempts, &deadLettered)
+	if err != nil {
+		return errors.Wrap(err, "store: failed to record processing failure")
+	}
+	if deadLettered {
+		log.Printf("store: dead-lettered pair %s (activity %d, route %s) after %d attempts: %v", p.ID, p.ActivityID, p.RouteID, attempts, cause)
+	} else {
+		log.Printf("store: failed to process pair %s (activity %d, route %s), attempt %d: %v", p.ID, p.ActivityID, p.RouteID, attempts, cause)
+	}
+	return nil
+}
+
+const recordFailureQuery = `
+UPDATE processing
+SET
+	attempts = attempts + 1,
+	last_error = $2,
+	dead_lettered_at = CASE WHEN attempts + 1 >= $3 THEN NOW() END
+WHERE id = $1
+RETURNING attempts, dead_lettered_at IS NOT NULL
+`
@@ -5,17 +5,24 @@ const (
 UPDATE processing
 SET processed = true
 FROM activities
+JOIN athletes ON athletes.id = activities.athlete_id
 WHERE
 	processing.activity_id = activities.id AND
 	processing.processed = false AND
-	activities.summary_track IS NULL
+	(
+		activities.summary_track IS NULL OR
+		-- Excluded by the athlete's preferences
+		(NOT athletes.count_private_activities AND (activities.private OR activities.hide_from_home))
+	)
 `
 
 	populateRelevantActivities = `
 INSERT INTO relevant_activities (
 	activity_id,
 	route_id,
-	relevant
+	relevant,
+	buffer_distance,
+	relevance_tolerance
 )
 SELECT
 	activities.id AS activity_id,
@@ -23,15 +30,14 @@ SELECT
 	ST_DWithin(
 		ST_Simplify(
 			activities.summary_track::geometry,
-			0.001
-		)::geography,
-		ST_Simplify(
-			routes.track::geometry,
-			0.001
+			routes.effective_relevance_tolerance
 		)::geography,
-	  	200, -- buffer distance
-	  	false -- Use sphere for speed
-	) AS relevant
+		routes.simplified_track,
+		routes.effective_buffer_distance,
+		false -- Use sphere for speed
+	) AS relevant,
+	routes.effective_buffer_distance AS buffer_distance,
+	routes.effective_relevance_tolerance AS relevance_tolerance
 FROM
 	activities
 CROSS JOIN routes
@@ -56,9 +62,10 @@ WITH
 	relevants AS (
 		SELECT
 			activities.id AS activity_id,
-			activities.summary_track AS activity_track,
+			COALESCE(activities.detailed_track, activities.summary_track) AS activity_track,
 			routes.id AS route_id,
-			routes.track AS route_track
+			routes.buffered_track AS buffered_route_track,
+			routes.effective_buffer_distance AS buffer_distance
 		FROM activities
 		JOIN relevant_activities ON relevant_activities.activity_id = activities.id
 		JOIN routes ON relevant_activities.route_id = routes.id
@@ -70,7 +77,8 @@ WITH
 INSERT INTO intersections (
 	activity_id,
 	route_id,
-	intersection_track
+	intersection_track,
+	buffer_distance
 )
 SELECT
 	activity_id,
@@ -78,12 +86,10 @@ SELECT
 	(ST_Dump(
 		ST_Intersection(
 			activity_track,
-			ST_Buffer(
-				route_track,
-				200 -- buffer distance
-			)
+			buffered_route_track
 		)::geometry
-	)).geom AS intersection_track
+	)).geom AS intersection_track,
+	buffer_distance
 FROM relevants
 `
 
@@ -2,7 +2,7 @@ package store
 
 const (
 	nextUnprocessed = `
-UPDATE processing SET processing_started_at = NOW()
+UPDATE processing SET processing_started_at = NOW(), lease_expires_at = NOW() + $1::interval
 WHERE processing.id = (
 	SELECT p.id FROM processing as p
 	WHERE p.processing_started_at IS NULL
@@ -22,17 +22,24 @@ WHERE id = $1
 UPDATE processing
 SET processed = true
 FROM activities
+JOIN athletes ON athletes.id = activities.athlete_id
 WHERE
 	processing.activity_id = activities.id AND
 	processing.id = $1 AND
-	activities.summary_track IS NULL
+	(
+		activities.summary_track IS NULL OR
+		-- Excluded by the athlete's preferences
+		(NOT athletes.count_private_activities AND (activities.private OR activities.hide_from_home))
+	)
 `
 
 	populateRelevantActivitiesOne = `
 INSERT INTO relevant_activities (
 	activity_id,
 	route_id,
-	relevant
+	relevant,
+	buffer_distance,
+	relevance_tolerance
 )
 SELECT
 	activities.id AS activity_id,
@@ -40,15 +47,14 @@ SELECT
 	ST_DWithin(
 		ST_Simplify(
 			activities.summary_track::geometry,
-			0.001
-		)::geography,
-		ST_Simplify(
-			routes.track::geometry,
-			0.001
+			routes.effective_relevance_tolerance
 		)::geography,
-		200, -- buffer distance
+		routes.simplified_track,
+		routes.effective_buffer_distance,
 		false -- Use sphere for speed
-	) AS relevant
+	) AS relevant,
+	routes.effective_buffer_distance AS buffer_distance,
+	routes.effective_relevance_tolerance AS relevance_tolerance
 FROM
 	activities
 CROSS JOIN routes
@@ -62,9 +68,10 @@ WITH
 	activity AS (
 		SELECT
 			activities.id AS activity_id,
-			activities.summary_track AS activity_track,
+			COALESCE(activities.detailed_track, activities.summary_track) AS activity_track,
 			routes.id AS route_id,
-			routes.track AS route_track
+			routes.buffered_track AS buffered_route_track,
+			routes.effective_buffer_distance AS buffer_distance
 		FROM activities
 		JOIN processing ON processing.activity_id = activities.id
 		JOIN routes ON processing.route_id = routes.id
@@ -74,7 +81,8 @@ WITH
 INSERT INTO intersections (
 	activity_id,
 	route_id,
-	intersection_track
+	intersection_track,
+	buffer_distance
 )
 SELECT
 	activity_id,
@@ -82,12 +90,10 @@ SELECT
 	(ST_Dump(
 		ST_Intersection(
 			activity_track,
-			ST_Buffer(
-				route_track,
-				200 -- buffer distance
-			)
+			buffered_route_track
 		)::geometry
-	)).geom AS intersection_track
+	)).geom AS intersection_track,
+	buffer_distance
 FROM activity
 `
 
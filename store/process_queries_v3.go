@@ -2,7 +2,7 @@ package store
 
 const (
 	nextUnprocessedBatch = `
-UPDATE processing SET processing_started_at = NOW()
+UPDATE processing SET processing_started_at = NOW(), lease_expires_at = NOW() + $2::interval
 WHERE processing.id = ANY(
 	SELECT p.id FROM processing as p
 	WHERE p.processing_started_at IS NULL
@@ -22,17 +22,24 @@ WHERE id = ANY($1)
 UPDATE processing
 SET processed = true
 FROM activities
+JOIN athletes ON athletes.id = activities.athlete_id
 WHERE
 	processing.activity_id = activities.id AND
 	processing.id = ANY($1) AND
-	activities.summary_track IS NULL
+	(
+		activities.summary_track IS NULL OR
+		-- Excluded by the athlete's preferences
+		(NOT athletes.count_private_activities AND (activities.private OR activities.hide_from_home))
+	)
 `
 
 	populateRelevantActivitiesBatch = `
 INSERT INTO relevant_activities (
 	activity_id,
 	route_id,
-	relevant
+	relevant,
+	buffer_distance,
+	relevance_tolerance
 )
 SELECT
 	activities.id AS activity_id,
@@ -40,15 +47,14 @@ SELECT
 	ST_DWithin(
 		ST_Simplify(
 			activities.summary_track::geometry,
-			0.001
-		)::geography,
-		ST_Simplify(
-			routes.track::geometry,
-			0.001
+			routes.effective_relevance_tolerance
 		)::geography,
-		200, -- buffer distance
+		routes.simplified_track,
+		routes.effective_buffer_distance,
 		false -- Use sphere for speed
-	) AS relevant
+	) AS relevant,
+	routes.effective_buffer_distance AS buffer_distance,
+	routes.effective_relevance_tolerance AS relevance_tolerance
 FROM
 	activities
 CROSS JOIN routes
@@ -62,9 +68,10 @@ WITH
 	relevants AS (
 		SELECT
 			activities.id AS activity_id,
-			activities.summary_track AS activity_track,
+			COALESCE(activities.detailed_track, activities.summary_track) AS activity_track,
 			routes.id AS route_id,
-			routes.track AS route_track
+			routes.buffered_track AS buffered_route_track,
+			routes.effective_buffer_distance AS buffer_distance
 		FROM activities
 		JOIN relevant_activities ON relevant_activities.activity_id = activities.id
 		JOIN routes ON relevant_activities.route_id = routes.id
@@ -77,7 +84,8 @@ WITH
 INSERT INTO intersections (
 	activity_id,
 	route_id,
-	intersection_track
+	intersection_track,
+	buffer_distance
 )
 SELECT
 	activity_id,
@@ -85,12 +93,10 @@ SELECT
 	(ST_Dump(
 		ST_Intersection(
 			activity_track,
-			ST_Buffer(
-				route_track,
-				200 -- buffer distance
-			)
+			buffered_route_track
 		)::geometry
-	)).geom AS intersection_track
+	)).geom AS intersection_track,
+	buffer_distance
 FROM relevants
 `
 
@@ -148,16 +154,41 @@ SELECT
 	section_track
 FROM sections
 WHERE GeometryType(section_track) = 'LINESTRING'
+`
+
+	// Recalculates route stats for the athlete/route combinations in the batch.
+	// See lockAthleteRouteStatsQuery.
+	lockRouteStatsBatch = `
+SELECT pg_advisory_xact_lock(lock_key)
+FROM (
+	SELECT DISTINCT hashtextextended('route_stats:' || activities.athlete_id || ':' || processing.route_id, 0) AS lock_key
+	FROM processing
+	JOIN activities ON activities.id = processing.activity_id
+	WHERE processing.id = ANY($1)
+	ORDER BY lock_key
+) AS keys
 `
 
 	updateRouteStatsBatch = `
-WITH rs as (
+WITH
+	touched AS (
+		SELECT DISTINCT
+			activities.athlete_id,
+			processing.route_id
+		FROM processing
+		JOIN activities ON activities.id = processing.activity_id
+		WHERE processing.id = ANY($1)
+	),
+	rs AS (
 		SELECT
-			route_sections.section_track,
-			route_sections.route_id,
-			activities.athlete_id
-		FROM route_sections
-		JOIN activities ON activities.id = route_sections.activity_id
+			touched.athlete_id,
+			touched.route_id,
+			route_sections.section_track
+		FROM touched
+		JOIN activities ON activities.athlete_id = touched.athlete_id
+		JOIN route_sections
+			ON route_sections.activity_id = activities.id
+			AND route_sections.route_id = touched.route_id
 	)
 	INSERT INTO route_stats (
 		route_id,
@@ -165,8 +196,8 @@ WITH rs as (
 		covered_length
 	)
 	SELECT
-		routes.id AS route_id,
-		athletes.id AS athlete_id,
+		touched.route_id,
+		touched.athlete_id,
 		COALESCE(
 			ST_Length(
 				ST_Union(
@@ -175,12 +206,11 @@ WITH rs as (
 			),
 			0
 		) AS covered_length
-	FROM routes
-	CROSS JOIN athletes
+	FROM touched
 	LEFT OUTER JOIN rs
-		ON rs.route_id = routes.id
-		AND rs.athlete_id = athletes.id
-	GROUP BY routes.id, athletes.id
+		ON rs.route_id = touched.route_id
+		AND rs.athlete_id = touched.athlete_id
+	GROUP BY touched.route_id, touched.athlete_id
 	ON CONFLICT (athlete_id, route_id) DO UPDATE
 	SET covered_length = EXCLUDED.covered_length
 `
@@ -4,8 +4,10 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/pkg/errors"
 )
 
@@ -17,14 +19,16 @@ type processable struct {
 	RouteID    string
 }
 
-func (s Store) ProcessOne(ctx context.Context) error {
+// ProcessOne claims a single unprocessed pair and processes it. The claim,
+// and failures caused by the pair, work the same way as in ProcessBatch.
+func (s Store) ProcessOne(ctx context.Context, lease time.Duration, maxAttempts int) error {
 	conn, err := s.pool.Acquire(ctx)
 	if err != nil {
 		return errors.Wrap(err, "failed to acquire connection")
 	}
 	defer conn.Release()
 
-	row := conn.QueryRow(ctx, nextUnprocessed)
+	row := conn.QueryRow(ctx, nextUnprocessed, lease)
 	var unprocessed processable
 	err = row.Scan(&unprocessed.ID, &unprocessed.ActivityID, &unprocessed.RouteID)
 	if err != nil {
@@ -35,6 +39,18 @@ func (s Store) ProcessOne(ctx context.Context) error {
 	}
 	// log.Printf("processing pair %s", unprocessed.ID)
 
+	err = s.processOne(ctx, conn, unprocessed)
+	if err != nil {
+		if isPairError(err) {
+			return recordFailure(ctx, conn, unprocessed, err, maxAttempts)
+		}
+		s.releaseClaims([]string{unprocessed.ID})
+		return err
+	}
+	return nil
+}
+
+func (s Store) processOne(ctx context.Context, conn *pgxpool.Conn, unprocessed processable) error {
 	tx, err := conn.BeginTx(ctx, pgx.TxOptions{
 		IsoLevel:   pgx.ReadCommitted,
 		AccessMode: pgx.ReadWrite,
@@ -49,7 +65,7 @@ func (s Store) ProcessOne(ctx context.Context) error {
 		}
 	}()
 
-	// Finish early if activity has no map
+	// Finish early if activity has no map, or the athlete has excluded it
 	n, err := tx.Exec(ctx, processNullMapOne, unprocessed.ID)
 	if err != nil {
 		return errors.Wrapf(err, "store: failed to process null map for processing pair %s", unprocessed.ID)
@@ -67,7 +83,7 @@ func (s Store) ProcessOne(ctx context.Context) error {
 	}
 
 	// Check if activity track is near route
-	row = tx.QueryRow(ctx, populateRelevantActivitiesOne, unprocessed.ActivityID, unprocessed.RouteID)
+	row := tx.QueryRow(ctx, populateRelevantActivitiesOne, unprocessed.ActivityID, unprocessed.RouteID)
 	var relevant bool
 	err = row.Scan(&relevant)
 	if err != nil {
@@ -3,8 +3,10 @@ package store
 import (
 	"context"
 	"log"
+	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/pkg/errors"
 )
 
@@ -18,14 +20,23 @@ func (b batch) IDs() []string {
 	return ids
 }
 
-func (s Store) ProcessBatch(ctx context.Context, batchSize int) (int, error) {
+// ProcessBatch claims up to batchSize unprocessed pairs and processes them.
+// The claim lasts for lease - if we haven't finished by then, e.g. because
+// we died, ReleaseExpiredClaims makes the pairs available to process again.
+// If processing fails, the claim is released straight away.
+//
+// If a pair can't be processed, e.g. because of bad geometry, the batch is
+// split to isolate it, and the rest of the batch is processed without it.
+// The failure is recorded against the pair, which is retried once its lease
+// expires, up to maxAttempts times before it's dead-lettered.
+func (s Store) ProcessBatch(ctx context.Context, batchSize int, lease time.Duration, maxAttempts int) (int, error) {
 	conn, err := s.pool.Acquire(ctx)
 	if err != nil {
 		return 0, errors.Wrap(err, "failed to acquire connection")
 	}
 	defer conn.Release()
 
-	rows, err := conn.Query(ctx, nextUnprocessedBatch, batchSize)
+	rows, err := conn.Query(ctx, nextUnprocessedBatch, batchSize, lease)
 	if err != nil {
 		return 0, errors.Wrap(err, "store: failed to get unprocessed batch")
 	}
@@ -43,12 +54,44 @@ func (s Store) ProcessBatch(ctx context.Context, batchSize int) (int, error) {
 	}
 	log.Printf("processing %d pairs", len(unprocessed))
 
+	err = s.processOrBisect(ctx, conn, unprocessed, maxAttempts)
+	if err != nil {
+		s.releaseClaims(unprocessed.IDs())
+		return 0, err
+	}
+	return len(unprocessed), nil
+}
+
+// Processes the batch in one transaction. If a pair causes that to fail,
+// splits the batch in half and processes each half separately, until the
+// pair is on its own.
+func (s Store) processOrBisect(ctx context.Context, conn *pgxpool.Conn, unprocessed batch, maxAttempts int) error {
+	err := s.processBatch(ctx, conn, unprocessed)
+	if err == nil || !isPairError(err) {
+		return err
+	}
+	if len(unprocessed) == 1 {
+		return recordFailure(ctx, conn, unprocessed[0], err, maxAttempts)
+	}
+
+	log.Printf("store: failed to process batch of %d pairs, splitting it to find the cause: %v", len(unprocessed), err)
+	mid := len(unprocessed) / 2
+	for _, half := range []batch{unprocessed[:mid], unprocessed[mid:]} {
+		err = s.processOrBisect(ctx, conn, half, maxAttempts)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s Store) processBatch(ctx context.Context, conn *pgxpool.Conn, unprocessed batch) error {
 	tx, err := conn.BeginTx(ctx, pgx.TxOptions{
 		IsoLevel:   pgx.ReadCommitted,
 		AccessMode: pgx.ReadWrite,
 	})
 	if err != nil {
-		return 0, errors.Wrap(err, "store: failed to begin transaction")
+		return errors.Wrap(err, "store: failed to begin transaction")
 	}
 	defer func() {
 		err := tx.Rollback(ctx)
@@ -57,57 +100,64 @@ func (s Store) ProcessBatch(ctx context.Context, batchSize int) (int, error) {
 		}
 	}()
 
-	// Finish early if activities have no map
+	// Finish early if activities have no map, or their athletes have excluded them
 	n, err := tx.Exec(ctx, processNullMapBatch, unprocessed.IDs())
 	if err != nil {
-		return 0, errors.Wrapf(err, "store: failed to process null maps")
+		return errors.Wrapf(err, "store: failed to process null maps")
 	}
 	// If all pairs were processed, we're done
-	if n.RowsAffected() == int64(batchSize) {
+	if n.RowsAffected() == int64(len(unprocessed)) {
 		err = tx.Commit(ctx)
 		if err != nil {
-			return 0, errors.Wrap(err, "store: error committing transaction")
+			return errors.Wrap(err, "store: error committing transaction")
 		}
-		return len(unprocessed), nil
+		return nil
 	}
 
 	// Check if activity tracks are near route
 	_, err = tx.Exec(ctx, populateRelevantActivitiesBatch, unprocessed.IDs())
 	if err != nil {
-		return 0, errors.Wrapf(err, "store: failed to populate relevant activities")
+		return errors.Wrapf(err, "store: failed to populate relevant activities")
 	}
 
 	// Intersections
 	_, err = tx.Exec(ctx, populateIntersectionsBatch, unprocessed.IDs())
 	if err != nil {
-		return 0, errors.Wrap(err, "store: failed to populate intersections")
+		return errors.Wrap(err, "store: failed to populate intersections")
 	}
 	// log.Printf("store: populated %d intersections for processing pair %s", n.RowsAffected(), unprocessed.ID)
 
 	// Route sections
 	_, err = tx.Exec(ctx, populateRouteSectionsBatch, unprocessed.IDs())
 	if err != nil {
-		return 0, errors.Wrap(err, "store: failed to populate route sections")
+		return errors.Wrap(err, "store: failed to populate route sections")
 	}
 	// log.Printf("store: populated %d route sections for processing pair %s", n.RowsAffected(), unprocessed.ID)
 
-	// Update route stats
-	_, err = tx.Exec(ctx, updateRouteStatsBatch)
+	// Wait for any other batch updating stats for the same athletes and routes
+	_, err = tx.Exec(ctx, lockRouteStatsBatch, unprocessed.IDs())
 	if err != nil {
-		return 0, errors.Wrap(err, "store: failed to populate route sections")
+		return errors.Wrap(err, "store: failed to lock route stats")
+	}
+
+	// Update route stats for the athletes and routes in this batch. A new
+	// statement, so it sees sections committed while we waited for the locks.
+	_, err = tx.Exec(ctx, updateRouteStatsBatch, unprocessed.IDs())
+	if err != nil {
+		return errors.Wrap(err, "store: failed to update route stats")
 	}
 	// log.Printf("store: populated route stats for route %s", unprocessed.RouteID)
 
 	// Mark activity as processed
 	_, err = tx.Exec(ctx, markAsProcessedBatch, unprocessed.IDs())
 	if err != nil {
-		return 0, errors.Wrap(err, "store: failed to mark as processed")
+		return errors.Wrap(err, "store: failed to mark as processed")
 	}
 	// log.Printf("store: marked processing pair %s as processed", unprocessed.ID)
 
 	err = tx.Commit(ctx)
 	if err != nil {
-		return 0, errors.Wrap(err, "store: error committing transaction")
+		return errors.Wrap(err, "store: error committing transaction")
 	}
-	return len(unprocessed), nil
+	return nil
 }
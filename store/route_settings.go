@@ -0,0 +1,26 @@
+package store
+
+import "context"
+
+// SetDefaultRouteSettings sets the settings used by routes that don't set
+// their own in routes.buffer_distance or routes.relevance_tolerance:
+//
+//   - bufferDistance is how many metres an activity may stray from a route and
+//     still count towards it.
+//   - relevanceTolerance is how many degrees tracks are simplified by when
+//     checking whether an activity is near a route at all.
+//
+// If they've changed, the affected routes' geometries are recalculated and
+// their activities are queued to be processed again. Returns whether they
+// changed.
+func (s Store) SetDefaultRouteSettings(ctx context.Context, bufferDistance, relevanceTolerance float64) (bool, error) {
+	n, err := s.pool.Exec(ctx, `
+UPDATE route_setting_defaults
+SET buffer_distance = $1, relevance_tolerance = $2
+WHERE buffer_distance <> $1 OR relevance_tolerance <> $2
+`, bufferDistance, relevanceTolerance)
+	if err != nil {
+		return false, err
+	}
+	return n.RowsAffected() > 0, nil
+}
@@ -0,0 +1,111 @@
+package store
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// RebuildRouteStats recalculates route stats for every athlete and route from
+// scratch, e.g. to repair them. Processing only updates the stats for the
+// athletes and routes it touches. Returns the number of rows written.
+func (s Store) RebuildRouteStats(ctx context.Context) (int, error) {
+	n, err := s.pool.Exec(ctx, rebuildRouteStatsQuery)
+	if err != nil {
+		return 0, err
+	}
+	return int(n.RowsAffected()), nil
+}
+
+const rebuildRouteStatsQuery = `
+WITH rs as (
+		SELECT
+			route_sections.section_track,
+			route_sections.route_id,
+			activities.athlete_id
+		FROM route_sections
+		JOIN activities ON activities.id = route_sections.activity_id
+	)
+	INSERT INTO route_stats (
+		route_id,
+		athlete_id,
+		covered_length
+	)
+	SELECT
+		routes.id AS route_id,
+		athletes.id AS athlete_id,
+		COALESCE(
+			ST_Length(
+				ST_Union(
+					rs.section_track::geometry
+				)::geography
+			),
+			0
+		) AS covered_length
+	FROM routes
+	CROSS JOIN athletes
+	LEFT OUTER JOIN rs
+		ON rs.route_id = routes.id
+		AND rs.athlete_id = athletes.id
+	GROUP BY routes.id, athletes.id
+	ON CONFLICT (athlete_id, route_id) DO UPDATE
+	SET covered_length = EXCLUDED.covered_length
+`
+
+// Recalculates route stats for every route for one athlete.
+// Recalculates the athlete's stats for every route, after taking the same
+// locks as processing, so neither overwrites the other with a total that's
+// missing the other's sections.
+func updateAthleteRouteStats(ctx context.Context, tx pgx.Tx, athleteID int) error {
+	_, err := tx.Exec(ctx, lockAthleteRouteStatsQuery, athleteID)
+	if err != nil {
+		return err
+	}
+	// A new statement, so it sees sections committed while we waited for the locks.
+	_, err = tx.Exec(ctx, updateAthleteRouteStatsQuery, athleteID)
+	return err
+}
+
+// Route stats are recalculated from all of an athlete's sections for a route,
+// so two transactions adding sections for the same athlete and route must
+// take turns. The locks are taken in order, so they can't deadlock.
+const lockAthleteRouteStatsQuery = `
+SELECT pg_advisory_xact_lock(lock_key)
+FROM (
+	SELECT hashtextextended('route_stats:' || $1::bigint || ':' || routes.id, 0) AS lock_key
+	FROM routes
+	ORDER BY lock_key
+) AS keys
+`
+
+const updateAthleteRouteStatsQuery = `
+WITH rs AS (
+		SELECT
+			route_sections.section_track,
+			route_sections.route_id
+		FROM route_sections
+		JOIN activities ON activities.id = route_sections.activity_id
+		WHERE activities.athlete_id = $1
+	)
+	INSERT INTO route_stats (
+		route_id,
+		athlete_id,
+		covered_length
+	)
+	SELECT
+		routes.id AS route_id,
+		$1::bigint AS athlete_id,
+		COALESCE(
+			ST_Length(
+				ST_Union(
+					rs.section_track::geometry
+				)::geography
+			),
+			0
+		) AS covered_length
+	FROM routes
+	LEFT OUTER JOIN rs ON rs.route_id = routes.id
+	GROUP BY routes.id
+	ON CONFLICT (athlete_id, route_id) DO UPDATE
+	SET covered_length = EXCLUDED.covered_length
+`
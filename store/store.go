@@ -9,10 +9,12 @@ import (
 )
 
 type Store struct {
-	pool *pgxpool.Pool
+	pool    *pgxpool.Pool
+	keyring *Keyring
 }
 
-func New(connectionURL string) (*Store, error) {
+// keyring is used to encrypt tokens at rest. If nil, tokens are stored in plaintext.
+func New(connectionURL string, keyring *Keyring) (*Store, error) {
 	ctx := context.Background()
 
 	pool, err := pgxpool.New(ctx, connectionURL)
@@ -21,7 +23,8 @@ func New(connectionURL string) (*Store, error) {
 	}
 
 	return &Store{
-		pool: pool,
+		pool:    pool,
+		keyring: keyring,
 	}, nil
 }
 
@@ -2,30 +2,75 @@ package store
 
 import (
 	"context"
+	"fmt"
+	"strconv"
 	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pkg/errors"
 )
 
+// ErrNoTokens is returned when we don't have tokens for an athlete, e.g.
+// because they've deauthorized us.
+var ErrNoTokens = errors.New("store: no tokens for athlete")
+
 type AccessToken struct {
 	Token     string
 	ExpiresAt time.Time
+	// Scopes granted by the athlete. nil if they weren't recorded when the
+	// athlete authorized us.
+	Scopes []string
+}
+
+// String redacts the token, so it's safe to log.
+func (a AccessToken) String() string {
+	return fmt.Sprintf("{Token:[redacted] ExpiresAt:%v Scopes:%v}", a.ExpiresAt, a.Scopes)
 }
 
 func (a AccessToken) IsExpired() bool {
 	return a.ExpiresAt.Before(time.Now())
 }
 
+// ExpiresWithin reports whether the token will have expired d from now.
+func (a AccessToken) ExpiresWithin(d time.Duration) bool {
+	return a.ExpiresAt.Before(time.Now().Add(d))
+}
+
+// HasScope reports whether the athlete granted the scope, or a broader scope that includes it.
+// Assumes the scope was granted if we don't know which scopes were granted.
+func (a AccessToken) HasScope(scope string) bool {
+	if a.Scopes == nil {
+		return true
+	}
+	for _, s := range a.Scopes {
+		if s == scope || s == scope+"_all" {
+			return true
+		}
+	}
+	return false
+}
+
 func (s Store) GetAccessToken(ctx context.Context, athleteID int) (*AccessToken, error) {
-	row := s.pool.QueryRow(ctx, "SELECT access_token, expires_at FROM access_tokens WHERE athlete_id = $1", athleteID)
+	row := s.pool.QueryRow(ctx, "SELECT access_token, expires_at, scopes FROM access_tokens WHERE athlete_id = $1", athleteID)
 
 	var accessToken string
 	var expiresAt time.Time
-	err := row.Scan(&accessToken, &expiresAt)
+	var scopes []string
+	err := row.Scan(&accessToken, &expiresAt, &scopes)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNoTokens
+		}
+		return nil, err
+	}
+	accessToken, err = s.keyring.decrypt(accessToken, accessTokenAAD(athleteID))
 	if err != nil {
 		return nil, err
 	}
 	return &AccessToken{
 		Token:     accessToken,
 		ExpiresAt: expiresAt,
+		Scopes:    scopes,
 	}, nil
 }
 
@@ -33,34 +78,219 @@ type RefreshToken struct {
 	Token string
 }
 
+// String redacts the token, so it's safe to log.
+func (r RefreshToken) String() string {
+	return "{Token:[redacted]}"
+}
+
 func (s Store) GetRefreshToken(ctx context.Context, athleteID int) (*RefreshToken, error) {
 	row := s.pool.QueryRow(ctx, "SELECT refresh_token FROM refresh_tokens WHERE athlete_id = $1", athleteID)
 
-	var accessToken string
-	err := row.Scan(&accessToken)
+	var refreshToken string
+	err := row.Scan(&refreshToken)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNoTokens
+		}
+		return nil, err
+	}
+	refreshToken, err = s.keyring.decrypt(refreshToken, refreshTokenAAD(athleteID))
 	if err != nil {
 		return nil, err
 	}
 	return &RefreshToken{
-		Token: accessToken,
+		Token: refreshToken,
 	}, nil
 }
 
-func (s Store) StoreTokens(ctx context.Context, athleteID int, accessToken, refreshToken string, expiresAt time.Time) error {
+// RefreshedTokens are the new tokens returned by Strava when refreshing.
+type RefreshedTokens struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresAt    time.Time
+}
+
+// RefreshTokens refreshes the athlete's tokens if due returns true for their
+// current access token, storing the tokens returned by refresh.
+//
+// The athlete's refresh token row is locked for the duration, so only one
+// instance refreshes at a time. Others wait, then see the refreshed access
+// token and skip refreshing. Without this, one instance could store a refresh
+// token that Strava has already replaced for another.
+func (s Store) RefreshTokens(
+	ctx context.Context,
+	athleteID int,
+	due func(AccessToken) bool,
+	refresh func(refreshToken string) (*RefreshedTokens, error),
+) (*AccessToken, error) {
 	tx, err := s.pool.Begin(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer tx.Rollback(ctx)
 
-	_, err = tx.Exec(ctx, "UPDATE access_tokens SET access_token = $1, expires_at = $2 WHERE athlete_id = $3", accessToken, expiresAt, athleteID)
+	var refreshToken string
+	err = tx.QueryRow(ctx, "SELECT refresh_token FROM refresh_tokens WHERE athlete_id = $1 FOR UPDATE", athleteID).Scan(&refreshToken)
 	if err != nil {
-		return err
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNoTokens
+		}
+		return nil, err
 	}
-	_, err = tx.Exec(ctx, "UPDATE refresh_tokens SET refresh_token = $1 WHERE athlete_id = $2", refreshToken, athleteID)
+
+	// Read the access token after taking the lock, in case someone else just refreshed it.
+	var token AccessToken
+	err = tx.QueryRow(ctx, "SELECT access_token, expires_at, scopes FROM access_tokens WHERE athlete_id = $1", athleteID).Scan(&token.Token, &token.ExpiresAt, &token.Scopes)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNoTokens
+		}
+		return nil, err
+	}
+	token.Token, err = s.keyring.decrypt(token.Token, accessTokenAAD(athleteID))
+	if err != nil {
+		return nil, err
+	}
+	if !due(token) {
+		return &token, tx.Commit(ctx)
+	}
+
+	refreshToken, err = s.keyring.decrypt(refreshToken, refreshTokenAAD(athleteID))
+	if err != nil {
+		return nil, err
+	}
+	refreshed, err := refresh(refreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedAccessToken, err := s.keyring.encrypt(refreshed.AccessToken, accessTokenAAD(athleteID))
+	if err != nil {
+		return nil, err
+	}
+	encryptedRefreshToken, err := s.keyring.encrypt(refreshed.RefreshToken, refreshTokenAAD(athleteID))
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(ctx, "UPDATE access_tokens SET access_token = $1, expires_at = $2 WHERE athlete_id = $3", encryptedAccessToken, refreshed.ExpiresAt, athleteID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(ctx, "UPDATE refresh_tokens SET refresh_token = $1 WHERE athlete_id = $2", encryptedRefreshToken, athleteID)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &AccessToken{
+		Token:     refreshed.AccessToken,
+		ExpiresAt: refreshed.ExpiresAt,
+		Scopes:    token.Scopes,
+	}, nil
+}
+
+func accessTokenAAD(athleteID int) string {
+	return "access_token:" + strconv.Itoa(athleteID)
+}
+
+func refreshTokenAAD(athleteID int) string {
+	return "refresh_token:" + strconv.Itoa(athleteID)
+}
+
+// ReencryptTokens re-encrypts any tokens not encrypted with the current key,
+// including plaintext tokens. Run it after changing the current key, before
+// removing the old one. Returns the number of athletes whose tokens were updated.
+func (s Store) ReencryptTokens(ctx context.Context) (int, error) {
+	if s.keyring == nil {
+		return 0, errors.New("store: no encryption keys configured")
+	}
+
+	rows, err := s.pool.Query(ctx, "SELECT athlete_id FROM refresh_tokens")
+	if err != nil {
+		return 0, err
+	}
+	athleteIDs := []int{}
+	for rows.Next() {
+		var athleteID int
+		err = rows.Scan(&athleteID)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		athleteIDs = append(athleteIDs, athleteID)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return 0, rows.Err()
+	}
+
+	updated := 0
+	for _, athleteID := range athleteIDs {
+		changed, err := s.reencryptAthleteTokens(ctx, athleteID)
+		if err != nil {
+			return updated, errors.Wrapf(err, "store: failed to re-encrypt tokens for athlete %d", athleteID)
+		}
+		if changed {
+			updated++
+		}
+	}
+	return updated, nil
+}
+
+// Takes the same lock as RefreshTokens, so we don't overwrite a concurrent refresh.
+func (s Store) reencryptAthleteTokens(ctx context.Context, athleteID int) (bool, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var refreshToken, accessToken string
+	err = tx.QueryRow(ctx, "SELECT refresh_token FROM refresh_tokens WHERE athlete_id = $1 FOR UPDATE", athleteID).Scan(&refreshToken)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			// Deleted since we listed athletes.
+			return false, nil
+		}
+		return false, err
+	}
+	err = tx.QueryRow(ctx, "SELECT access_token FROM access_tokens WHERE athlete_id = $1", athleteID).Scan(&accessToken)
 	if err != nil {
-		return err
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	if !s.keyring.needsReencryption(refreshToken) && !s.keyring.needsReencryption(accessToken) {
+		return false, nil
+	}
+
+	for _, t := range []struct {
+		value *string
+		aad   string
+	}{
+		{&refreshToken, refreshTokenAAD(athleteID)},
+		{&accessToken, accessTokenAAD(athleteID)},
+	} {
+		plaintext, err := s.keyring.decrypt(*t.value, t.aad)
+		if err != nil {
+			return false, err
+		}
+		*t.value, err = s.keyring.encrypt(plaintext, t.aad)
+		if err != nil {
+			return false, err
+		}
 	}
 
-	return tx.Commit(ctx)
+	_, err = tx.Exec(ctx, "UPDATE access_tokens SET access_token = $1 WHERE athlete_id = $2", accessToken, athleteID)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(ctx, "UPDATE refresh_tokens SET refresh_token = $1 WHERE athlete_id = $2", refreshToken, athleteID)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
 }
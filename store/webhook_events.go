@@ -0,0 +1,184 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pkg/errors"
+)
+
+type WebhookEventStatus string
+
+const (
+	WebhookEventPending    WebhookEventStatus = "pending"
+	WebhookEventProcessing WebhookEventStatus = "processing"
+	WebhookEventDone       WebhookEventStatus = "done"
+	WebhookEventFailed     WebhookEventStatus = "failed"
+)
+
+// WebhookEvent is a raw webhook event received from Strava, waiting to be processed.
+type WebhookEvent struct {
+	ID      int64
+	Payload []byte
+	// Number of times processing has been attempted, including the current attempt.
+	Attempts int
+}
+
+// WebhookEventKey identifies an event. Strava may deliver the same event more
+// than once, but it will always have the same key.
+type WebhookEventKey struct {
+	ObjectType string
+	ObjectID   int
+	AspectType string
+	// Seconds since the epoch.
+	EventTime int
+}
+
+// Stores a webhook event to be processed asynchronously.
+// Returns false if we've already received the event.
+func (s Store) StoreWebhookEvent(ctx context.Context, key WebhookEventKey, payload []byte) (int64, bool, error) {
+	row := s.pool.QueryRow(
+		ctx,
+		insertWebhookEventQuery,
+		key.ObjectType,
+		key.ObjectID,
+		key.AspectType,
+		key.EventTime,
+		payload,
+	)
+	var id int64
+	err := row.Scan(&id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	return id, true, nil
+}
+
+const insertWebhookEventQuery = `
+INSERT INTO webhook_events (object_type, object_id, aspect_type, event_time, payload)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (object_type, object_id, aspect_type, event_time) DO NOTHING
+RETURNING id
+`
+
+// Claims up to limit events that are due to be processed. Events claimed more
+// than lease ago that are still processing are assumed to belong to a worker
+// that died, and are claimed again.
+//
+// Events for the same object are claimed one at a time, in the order they
+// happened, so an event is never processed before an earlier one for the same
+// object. Events that have failed for good don't hold up later ones.
+func (s Store) ClaimWebhookEvents(ctx context.Context, limit int, lease time.Duration) ([]WebhookEvent, error) {
+	rows, err := s.pool.Query(ctx, claimWebhookEventsQuery, limit, lease)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []WebhookEvent{}
+	for rows.Next() {
+		var e WebhookEvent
+		err = rows.Scan(&e.ID, &e.Payload, &e.Attempts)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+const claimWebhookEventsQuery = `
+UPDATE webhook_events
+SET
+	status = 'processing',
+	attempts = attempts + 1,
+	updated_at = NOW()
+WHERE id = ANY(
+	SELECT e.id FROM webhook_events AS e
+	WHERE (
+		(e.status = 'pending' AND e.next_attempt_at <= NOW()) OR
+		(e.status = 'processing' AND e.updated_at < NOW() - $2::interval)
+	) AND NOT EXISTS (
+		SELECT 1 FROM webhook_events AS earlier
+		WHERE
+			earlier.object_type = e.object_type AND
+			earlier.object_id = e.object_id AND
+			earlier.status IN ('pending', 'processing') AND
+			(earlier.event_time, earlier.id) < (e.event_time, e.id)
+	)
+	ORDER BY e.event_time ASC, e.id ASC
+	LIMIT $1
+	FOR UPDATE SKIP LOCKED
+)
+RETURNING id, payload, attempts
+`
+
+func (s Store) CompleteWebhookEvent(ctx context.Context, id int64) error {
+	_, err := s.pool.Exec(ctx, "UPDATE webhook_events SET status = 'done', last_error = NULL, updated_at = NOW() WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Records a failed attempt to process an event. The event is retried at
+// retryAt, or marked as failed for good if retryAt is nil.
+func (s Store) FailWebhookEvent(ctx context.Context, id int64, lastError string, retryAt *time.Time) error {
+	status := WebhookEventFailed
+	nextAttemptAt := time.Now()
+	if retryAt != nil {
+		status = WebhookEventPending
+		nextAttemptAt = *retryAt
+	}
+	_, err := s.pool.Exec(ctx, failWebhookEventQuery, id, status, lastError, nextAttemptAt)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+const failWebhookEventQuery = `
+UPDATE webhook_events
+SET
+	status = $2,
+	last_error = $3,
+	next_attempt_at = $4,
+	updated_at = NOW()
+WHERE id = $1
+`
+
+// Puts an event back to be processed at retryAt, without counting this as one
+// of its attempts, e.g. because we were rate limited before we could try.
+func (s Store) DeferWebhookEvent(ctx context.Context, id int64, reason string, retryAt time.Time) error {
+	_, err := s.pool.Exec(ctx, deferWebhookEventQuery, id, reason, retryAt)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Claiming counted an attempt, so take it back off.
+const deferWebhookEventQuery = `
+UPDATE webhook_events
+SET
+	status = 'pending',
+	attempts = GREATEST(attempts - 1, 0),
+	last_error = $2,
+	next_attempt_at = $3,
+	updated_at = NOW()
+WHERE id = $1
+`
+
+// Returns when the most recent webhook event was received, or nil if none have been.
+func (s Store) LastWebhookEventAt(ctx context.Context) (*time.Time, error) {
+	var receivedAt *time.Time
+	err := s.pool.QueryRow(ctx, "SELECT MAX(received_at) FROM webhook_events").Scan(&receivedAt)
+	if err != nil {
+		return nil, err
+	}
+	return receivedAt, nil
+}
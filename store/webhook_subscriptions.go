@@ -0,0 +1,44 @@
+package store
+
+import (
+	"context"
+)
+
+// WebhookSubscription is our Strava push subscription for a callback URL.
+type WebhookSubscription struct {
+	CallbackURL string
+	VerifyToken string
+	// 0 if the subscription hasn't been created yet.
+	ID int
+}
+
+// Gets the subscription for the callback URL, recording it with verifyToken
+// if we don't have one yet. Every instance gets the same verify token, so any
+// of them can answer Strava's validation request.
+func (s Store) InitWebhookSubscription(ctx context.Context, callbackURL, verifyToken string) (*WebhookSubscription, error) {
+	_, err := s.pool.Exec(ctx, "INSERT INTO webhook_subscriptions (callback_url, verify_token) VALUES ($1, $2) ON CONFLICT (callback_url) DO NOTHING", callbackURL, verifyToken)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetWebhookSubscription(ctx, callbackURL)
+}
+
+func (s Store) GetWebhookSubscription(ctx context.Context, callbackURL string) (*WebhookSubscription, error) {
+	row := s.pool.QueryRow(ctx, "SELECT verify_token, COALESCE(subscription_id, 0) FROM webhook_subscriptions WHERE callback_url = $1", callbackURL)
+
+	sub := WebhookSubscription{CallbackURL: callbackURL}
+	err := row.Scan(&sub.VerifyToken, &sub.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+// Records the ID Strava gave the subscription. 0 records that it no longer exists.
+func (s Store) SetWebhookSubscriptionID(ctx context.Context, callbackURL string, id int) error {
+	_, err := s.pool.Exec(ctx, "UPDATE webhook_subscriptions SET subscription_id = NULLIF($2::bigint, 0), updated_at = NOW() WHERE callback_url = $1", callbackURL, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -1,8 +1,8 @@
 package strava
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strconv"
@@ -23,13 +23,18 @@ type GetActivityResponse struct {
 }
 
 func (s *API) GetActivity(req GetActivityRequest) (*GetActivityResponse, error) {
-	url := baseURL + activitiesPath + "/" + strconv.Itoa(req.ID)
-	request, err := http.NewRequest("GET", url, nil)
+	return s.GetActivityWithContext(context.Background(), req)
+}
+
+func (s *API) GetActivityWithContext(ctx context.Context, req GetActivityRequest) (*GetActivityResponse, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.GetActivity)
+	defer cancel()
+	request, err := s.newRequest(ctx, http.MethodGet, activitiesPath+"/"+strconv.Itoa(req.ID), nil)
 	if err != nil {
 		return nil, err
 	}
 	request.Header.Set("Authorization", "Bearer "+req.AccessToken)
-	resp, err := s.client.Do(request)
+	resp, err := s.doWithRetry(request)
 	if err != nil {
 		return nil, err
 	}
@@ -39,7 +44,7 @@ func (s *API) GetActivity(req GetActivityRequest) (*GetActivityResponse, error)
 		return nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("strava: failed to get activity: %s", string(respBody))
+		return nil, newAPIError("get activity", resp, respBody, s.RateLimit())
 	}
 	var response GetActivityResponse
 	err = json.Unmarshal(respBody, &response)
@@ -0,0 +1,78 @@
+package strava
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	athleteActivitiesPath = "/athlete/activities"
+)
+
+type ListAthleteActivitiesRequest struct {
+	AccessToken string
+	// Only return activities that started before this time, if set.
+	Before time.Time
+	// Only return activities that started after this time, if set.
+	// Strava returns activities in ascending start order when After is set,
+	// and descending order otherwise.
+	After   time.Time
+	Page    int
+	PerPage int
+}
+
+// Strava returns SummaryActivity objects here, which have a subset of the
+// fields of DetailedActivity. The fields we store are present in both.
+type ListAthleteActivitiesResponse []DetailedActivity
+
+func (s *API) ListAthleteActivities(req ListAthleteActivitiesRequest) (ListAthleteActivitiesResponse, error) {
+	return s.ListAthleteActivitiesWithContext(context.Background(), req)
+}
+
+func (s *API) ListAthleteActivitiesWithContext(ctx context.Context, req ListAthleteActivitiesRequest) (ListAthleteActivitiesResponse, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.GetActivity)
+	defer cancel()
+
+	q := url.Values{}
+	if !req.Before.IsZero() {
+		q.Set("before", strconv.FormatInt(req.Before.Unix(), 10))
+	}
+	if !req.After.IsZero() {
+		q.Set("after", strconv.FormatInt(req.After.Unix(), 10))
+	}
+	if req.Page > 0 {
+		q.Set("page", strconv.Itoa(req.Page))
+	}
+	if req.PerPage > 0 {
+		q.Set("per_page", strconv.Itoa(req.PerPage))
+	}
+
+	request, err := s.newRequest(ctx, http.MethodGet, athleteActivitiesPath+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+req.AccessToken)
+	resp, err := s.doWithRetry(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError("list athlete activities", resp, respBody, s.RateLimit())
+	}
+	var response ListAthleteActivitiesResponse
+	err = json.Unmarshal(respBody, &response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
@@ -0,0 +1,117 @@
+package strava
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// FaultError is a single entry in the errors array of a Strava fault.
+type FaultError struct {
+	Resource string `json:"resource"`
+	Field    string `json:"field"`
+	Code     string `json:"code"`
+}
+
+// Fault is the error payload returned by Strava on failed requests.
+type Fault struct {
+	Message string       `json:"message"`
+	Errors  []FaultError `json:"errors"`
+}
+
+// APIError is returned when Strava responds with an unexpected status code.
+type APIError struct {
+	// Op describes the operation that failed, e.g. "get activity".
+	Op         string
+	StatusCode int
+	Fault      Fault
+	RateLimit  RateLimit
+}
+
+func newAPIError(op string, resp *http.Response, body []byte, rateLimit RateLimit) *APIError {
+	e := &APIError{
+		Op:         op,
+		StatusCode: resp.StatusCode,
+		RateLimit:  rateLimit,
+	}
+	err := json.Unmarshal(body, &e.Fault)
+	if err != nil || e.Fault.Message == "" {
+		e.Fault.Message = strings.TrimSpace(string(body))
+	}
+	return e
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("strava: failed to %s: %d %s", e.Op, e.StatusCode, e.Fault.Message)
+	for _, fe := range e.Fault.Errors {
+		msg += fmt.Sprintf(" (%s.%s: %s)", fe.Resource, fe.Field, fe.Code)
+	}
+	return msg
+}
+
+// Temporary reports whether the request may succeed if retried later.
+func (e *APIError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+func statusCode(err error) int {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode
+	}
+	return 0
+}
+
+// IsUnauthorized reports whether err is an APIError caused by an invalid or revoked token.
+func IsUnauthorized(err error) bool {
+	return statusCode(err) == http.StatusUnauthorized
+}
+
+// IsInvalidGrant reports whether err is an APIError caused by a refresh token
+// or authorization code that is invalid, e.g. because the athlete revoked our access.
+//
+// Only the fault tells us that. A bad client ID or secret, or a malformed
+// request, gets the same status code.
+func IsInvalidGrant(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.StatusCode != http.StatusBadRequest && apiErr.StatusCode != http.StatusUnauthorized {
+		return false
+	}
+	for _, fe := range apiErr.Fault.Errors {
+		if fe.Code != "invalid" {
+			continue
+		}
+		if fe.Resource == "RefreshToken" || fe.Field == "refresh_token" ||
+			fe.Resource == "AuthorizationCode" || fe.Field == "code" {
+			return true
+		}
+	}
+	return false
+}
+
+// IsForbidden reports whether err is an APIError caused by the token lacking the required scope.
+func IsForbidden(err error) bool {
+	return statusCode(err) == http.StatusForbidden
+}
+
+// IsNotFound reports whether err is an APIError caused by a missing resource,
+// e.g. an activity that has since been deleted.
+func IsNotFound(err error) bool {
+	return statusCode(err) == http.StatusNotFound
+}
+
+// IsRateLimited reports whether err was caused by Strava's rate limits, either
+// because Strava rejected the request or because we held it back.
+func IsRateLimited(err error) bool {
+	return errors.Is(err, ErrRateLimited) || statusCode(err) == http.StatusTooManyRequests
+}
+
+// IsServerError reports whether err is an APIError caused by a failure on Strava's side.
+func IsServerError(err error) bool {
+	return statusCode(err) >= 500
+}
@@ -0,0 +1,201 @@
+package strava
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned when a request would exceed Strava's rate limits.
+var ErrRateLimited = errors.New("strava: rate limit reached")
+
+const (
+	rateLimitLimitHeader = "X-RateLimit-Limit"
+	rateLimitUsageHeader = "X-RateLimit-Usage"
+
+	shortTermWindow = 15 * time.Minute
+)
+
+// RateLimit is a snapshot of our usage against Strava's rate limits.
+//
+// Strava enforces a short term (15 minute) limit and a long term (daily) limit.
+// The short term window resets at natural 15 minute boundaries, and the long
+// term window resets at midnight UTC.
+//
+// A limit of 0 means we haven't seen the limit reported by Strava yet.
+type RateLimit struct {
+	ShortTermLimit int
+	ShortTermUsage int
+	LongTermLimit  int
+	LongTermUsage  int
+	UpdatedAt      time.Time
+}
+
+// ShortTermExhausted reports whether no more requests can be made in the current 15 minute window.
+func (r RateLimit) ShortTermExhausted() bool {
+	return r.ShortTermLimit > 0 && r.ShortTermUsage >= r.ShortTermLimit
+}
+
+// LongTermExhausted reports whether no more requests can be made today.
+func (r RateLimit) LongTermExhausted() bool {
+	return r.LongTermLimit > 0 && r.LongTermUsage >= r.LongTermLimit
+}
+
+// Exhausted reports whether either limit has been reached.
+func (r RateLimit) Exhausted() bool {
+	return r.ShortTermExhausted() || r.LongTermExhausted()
+}
+
+// ShortTermResetsAt returns when the current 15 minute window ends.
+func (r RateLimit) ShortTermResetsAt() time.Time {
+	return nextShortTermReset(time.Now())
+}
+
+// LongTermResetsAt returns when the current daily window ends.
+func (r RateLimit) LongTermResetsAt() time.Time {
+	return nextLongTermReset(time.Now())
+}
+
+// RateLimiter tracks rate limit usage across all requests made through an API.
+// It's safe for concurrent use, and may be shared between multiple APIs using
+// the same Strava application.
+type RateLimiter struct {
+	mu        sync.Mutex
+	state     RateLimit
+	checkedAt time.Time
+	maxWait   time.Duration
+}
+
+// NewRateLimiter creates a RateLimiter. Requests made when the short term limit
+// has been reached will wait for the window to reset if it resets within maxWait,
+// otherwise they fail with ErrRateLimited.
+func NewRateLimiter(maxWait time.Duration) *RateLimiter {
+	return &RateLimiter{
+		maxWait: maxWait,
+	}
+}
+
+// RateLimit returns the current rate limit state.
+func (r *RateLimiter) RateLimit() RateLimit {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resetExpired(time.Now())
+	return r.state
+}
+
+// wait blocks until a request can be made without exceeding the rate limit,
+// then counts the request against the limit.
+func (r *RateLimiter) wait(ctx context.Context) error {
+	for {
+		delay, err := r.reserve(time.Now())
+		if err != nil {
+			return err
+		}
+		if delay == 0 {
+			return nil
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// reserve counts a request against the limit if there is room for it.
+// Otherwise, it returns how long to wait before trying again, or
+// ErrRateLimited if that would be longer than maxWait.
+func (r *RateLimiter) reserve(now time.Time) (time.Duration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resetExpired(now)
+
+	if r.state.LongTermExhausted() {
+		return 0, ErrRateLimited
+	}
+	if r.state.ShortTermExhausted() {
+		delay := nextShortTermReset(now).Sub(now)
+		if delay > r.maxWait {
+			return 0, ErrRateLimited
+		}
+		return delay, nil
+	}
+
+	// Count the request now, so concurrent callers see it before Strava
+	// reports the updated usage.
+	r.state.ShortTermUsage++
+	r.state.LongTermUsage++
+	return 0, nil
+}
+
+// update records the usage reported in a response from Strava.
+func (r *RateLimiter) update(resp *http.Response) {
+	limits, ok := parseRateLimitHeader(resp.Header.Get(rateLimitLimitHeader))
+	if !ok {
+		return
+	}
+	usage, ok := parseRateLimitHeader(resp.Header.Get(rateLimitUsageHeader))
+	if !ok {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.state = RateLimit{
+		ShortTermLimit: limits[0],
+		ShortTermUsage: usage[0],
+		LongTermLimit:  limits[1],
+		LongTermUsage:  usage[1],
+		UpdatedAt:      time.Now(),
+	}
+	r.checkedAt = r.state.UpdatedAt
+	if resp.StatusCode == http.StatusTooManyRequests && !r.state.Exhausted() {
+		// We can't tell which limit we hit, so assume the short term one.
+		r.state.ShortTermUsage = r.state.ShortTermLimit
+	}
+}
+
+// resetExpired clears usage from windows that have ended since we last checked.
+func (r *RateLimiter) resetExpired(now time.Time) {
+	if !r.checkedAt.IsZero() {
+		if !now.Before(nextShortTermReset(r.checkedAt)) {
+			r.state.ShortTermUsage = 0
+		}
+		if !now.Before(nextLongTermReset(r.checkedAt)) {
+			r.state.LongTermUsage = 0
+		}
+	}
+	r.checkedAt = now
+}
+
+func nextShortTermReset(t time.Time) time.Time {
+	return t.UTC().Truncate(shortTermWindow).Add(shortTermWindow)
+}
+
+func nextLongTermReset(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+// Parses headers of the form "600,30000" into short term and long term values.
+func parseRateLimitHeader(value string) ([2]int, bool) {
+	var result [2]int
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return result, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return result, false
+		}
+		result[i] = n
+	}
+	return result, true
+}
@@ -0,0 +1,152 @@
+package strava
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Published on /debug/vars.
+var retryMetrics = expvar.NewMap("strava_requests")
+
+// RetryPolicy controls how requests that fail transiently are retried.
+//
+// Only idempotent requests are retried. Delays grow exponentially from
+// BaseDelay up to MaxDelay, with full jitter. A Retry-After header from
+// Strava takes precedence if it asks us to wait longer.
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt. Values below 2 disable retries.
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+}
+
+// WithRetryPolicy sets the policy for retrying failed requests.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(a *API) {
+		a.retryPolicy = policy
+	}
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.MaxDelay
+	if shift := attempt - 1; shift < 32 {
+		if d := p.BaseDelay << shift; d > 0 && d < delay {
+			delay = d
+		}
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// doWithRetry sends a request with do, retrying network errors, 5xx and 429
+// responses according to the retry policy. The final response is returned
+// as-is, so callers handle status codes the same way as with do.
+//
+// The request body must be replayable, which http.NewRequest arranges for
+// bytes.Buffer, bytes.Reader and strings.Reader bodies.
+func (s *API) doWithRetry(request *http.Request) (*http.Response, error) {
+	ctx := request.Context()
+	for attempt := 1; ; attempt++ {
+		req := request
+		if attempt > 1 {
+			req = request.Clone(ctx)
+			if request.GetBody != nil {
+				body, err := request.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				req.Body = body
+			}
+			retryMetrics.Add("retries", 1)
+		}
+		retryMetrics.Add("attempts", 1)
+
+		resp, err := s.do(req)
+		final := attempt >= s.retryPolicy.MaxAttempts
+		var retryAfter time.Duration
+		if err != nil {
+			if final || !retryableError(ctx, err) {
+				if final {
+					retryMetrics.Add("exhausted", 1)
+				}
+				return nil, err
+			}
+		} else {
+			if !retryableStatus(resp.StatusCode) {
+				return resp, nil
+			}
+			if final {
+				retryMetrics.Add("exhausted", 1)
+				return resp, nil
+			}
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+			// Drain the body so the connection can be reused.
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		delay := s.retryPolicy.backoff(attempt)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		if err != nil {
+			log.Printf("strava: %s %s failed, retrying in %v (attempt %d): %v", request.Method, request.URL.Path, delay, attempt, err)
+		} else {
+			log.Printf("strava: %s %s returned %d, retrying in %v (attempt %d)", request.Method, request.URL.Path, resp.StatusCode, delay, attempt)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func retryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+func retryableError(ctx context.Context, err error) bool {
+	// Our own rate limiter has already waited as long as it's allowed to.
+	if errors.Is(err, ErrRateLimited) {
+		return false
+	}
+	// Cancelled or timed out by the caller.
+	if ctx.Err() != nil {
+		return false
+	}
+	return true
+}
+
+// Parses a Retry-After header given either in seconds or as an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return t.Sub(now)
+	}
+	return 0
+}
@@ -1,23 +1,137 @@
 package strava
 
 import (
+	"context"
+	"io"
 	"net/http"
+	"time"
 )
 
 const (
-	baseURL = "https://www.strava.com/api/v3"
+	defaultBaseURL = "https://www.strava.com/api/v3"
 )
 
 type API struct {
 	client       *http.Client
+	baseURL      string
+	userAgent    string
+	timeout      time.Duration
+	rateLimiter  *RateLimiter
+	timeouts     Timeouts
+	retryPolicy  RetryPolicy
 	clientID     int
 	clientSecret string
 }
 
-func NewAPI(clientID int, clientSecret string) *API {
-	return &API{
+// Option configures an API created with NewAPI.
+type Option func(*API)
+
+// WithBaseURL overrides the Strava API base URL, e.g. to point at a local
+// stand-in or a recording proxy.
+func WithBaseURL(baseURL string) Option {
+	return func(a *API) {
+		a.baseURL = baseURL
+	}
+}
+
+// WithHTTPClient sets the HTTP client used for all requests.
+func WithHTTPClient(client *http.Client) Option {
+	return func(a *API) {
+		a.client = client
+	}
+}
+
+// WithUserAgent sets the User-Agent header sent with all requests.
+func WithUserAgent(userAgent string) Option {
+	return func(a *API) {
+		a.userAgent = userAgent
+	}
+}
+
+// WithTimeout sets an overall timeout for each request.
+func WithTimeout(timeout time.Duration) Option {
+	return func(a *API) {
+		a.timeout = timeout
+	}
+}
+
+// Timeouts sets deadlines for individual calls, on top of any deadline already
+// set on the context passed in. A zero value means no per-call deadline.
+type Timeouts struct {
+	GetActivity  time.Duration
+	RefreshToken time.Duration
+	Subscription time.Duration
+}
+
+// WithTimeouts sets per-call deadlines.
+func WithTimeouts(timeouts Timeouts) Option {
+	return func(a *API) {
+		a.timeouts = timeouts
+	}
+}
+
+// WithRateLimiter sets the RateLimiter used to track usage against Strava's
+// rate limits. Share a RateLimiter between APIs using the same Strava application.
+func WithRateLimiter(rateLimiter *RateLimiter) Option {
+	return func(a *API) {
+		a.rateLimiter = rateLimiter
+	}
+}
+
+func NewAPI(clientID int, clientSecret string, opts ...Option) *API {
+	a := &API{
 		client:       &http.Client{},
+		baseURL:      defaultBaseURL,
+		rateLimiter:  NewRateLimiter(0),
+		retryPolicy:  defaultRetryPolicy,
 		clientID:     clientID,
 		clientSecret: clientSecret,
 	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	if a.timeout > 0 {
+		// Copy the client so we don't modify one passed in with WithHTTPClient.
+		client := *a.client
+		client.Timeout = a.timeout
+		a.client = &client
+	}
+	return a
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (s *API) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, method, s.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if s.userAgent != "" {
+		request.Header.Set("User-Agent", s.userAgent)
+	}
+	return request, nil
+}
+
+// do sends a request, respecting and updating the rate limit state.
+func (s *API) do(request *http.Request) (*http.Response, error) {
+	err := s.rateLimiter.wait(request.Context())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	s.rateLimiter.update(resp)
+	return resp, nil
+}
+
+// RateLimit returns our current usage against Strava's rate limits.
+func (s *API) RateLimit() RateLimit {
+	return s.rateLimiter.RateLimit()
 }
@@ -0,0 +1,112 @@
+package strava
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type StreamType string
+
+const (
+	StreamTypeLatLng   StreamType = "latlng"
+	StreamTypeTime     StreamType = "time"
+	StreamTypeAltitude StreamType = "altitude"
+	StreamTypeDistance StreamType = "distance"
+)
+
+type BaseStream struct {
+	OriginalSize int    `json:"original_size"`
+	Resolution   string `json:"resolution"`
+	SeriesType   string `json:"series_type"`
+}
+
+type LatLngStream struct {
+	BaseStream
+	Data []LatLong `json:"data"`
+}
+
+type TimeStream struct {
+	BaseStream
+	Data []int `json:"data"`
+}
+
+type AltitudeStream struct {
+	BaseStream
+	Data []float64 `json:"data"`
+}
+
+type DistanceStream struct {
+	BaseStream
+	Data []float64 `json:"data"`
+}
+
+// StreamSet holds the streams we request. A stream is nil if the activity doesn't have it,
+// e.g. LatLng for an activity recorded without GPS.
+type StreamSet struct {
+	LatLng   *LatLngStream   `json:"latlng"`
+	Time     *TimeStream     `json:"time"`
+	Altitude *AltitudeStream `json:"altitude"`
+	Distance *DistanceStream `json:"distance"`
+}
+
+type GetActivityStreamsRequest struct {
+	AccessToken string
+	ID          int
+	// Defaults to latlng, time, altitude and distance.
+	Keys []StreamType
+}
+
+type GetActivityStreamsResponse struct {
+	StreamSet
+}
+
+func (s *API) GetActivityStreams(req GetActivityStreamsRequest) (*GetActivityStreamsResponse, error) {
+	return s.GetActivityStreamsWithContext(context.Background(), req)
+}
+
+func (s *API) GetActivityStreamsWithContext(ctx context.Context, req GetActivityStreamsRequest) (*GetActivityStreamsResponse, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.GetActivity)
+	defer cancel()
+
+	keys := req.Keys
+	if len(keys) == 0 {
+		keys = []StreamType{StreamTypeLatLng, StreamTypeTime, StreamTypeAltitude, StreamTypeDistance}
+	}
+	keyStrings := make([]string, len(keys))
+	for i, k := range keys {
+		keyStrings[i] = string(k)
+	}
+	q := url.Values{
+		"keys":        {strings.Join(keyStrings, ",")},
+		"key_by_type": {"true"},
+	}
+
+	request, err := s.newRequest(ctx, http.MethodGet, activitiesPath+"/"+strconv.Itoa(req.ID)+"/streams?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+req.AccessToken)
+	resp, err := s.doWithRetry(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError("get activity streams", resp, respBody, s.RateLimit())
+	}
+	var response GetActivityStreamsResponse
+	err = json.Unmarshal(respBody, &response)
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
@@ -2,8 +2,8 @@ package strava
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -32,6 +32,12 @@ type createSubscriptionRequest struct {
 }
 
 func (s *API) CreateSubscription(req CreateSubscriptionRequest) (*CreateSubscriptionResponse, error) {
+	return s.CreateSubscriptionWithContext(context.Background(), req)
+}
+
+func (s *API) CreateSubscriptionWithContext(ctx context.Context, req CreateSubscriptionRequest) (*CreateSubscriptionResponse, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Subscription)
+	defer cancel()
 	log.Println("strava: creating strava webhooks subscription")
 	r := createSubscriptionRequest{
 		ClientID:     s.clientID,
@@ -43,8 +49,12 @@ func (s *API) CreateSubscription(req CreateSubscriptionRequest) (*CreateSubscrip
 	if err != nil {
 		return nil, err
 	}
-	url := baseURL + subscriptionPath
-	resp, err := s.client.Post(url, "application/json", bytes.NewBuffer(reqBody))
+	request, err := s.newRequest(ctx, http.MethodPost, subscriptionPath, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	resp, err := s.do(request)
 	if err != nil {
 		return nil, err
 	}
@@ -54,7 +64,7 @@ func (s *API) CreateSubscription(req CreateSubscriptionRequest) (*CreateSubscrip
 		return nil, err
 	}
 	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("strava: failed to create subscription: %s", string(respBody))
+		return nil, newAPIError("create subscription", resp, respBody, s.RateLimit())
 	}
 	var response CreateSubscriptionResponse
 	err = json.Unmarshal(respBody, &response)
@@ -74,16 +84,21 @@ type ViewSubscriptionResponse struct {
 }
 
 func (s *API) ViewSubscription() ([]ViewSubscriptionResponse, error) {
+	return s.ViewSubscriptionWithContext(context.Background())
+}
+
+func (s *API) ViewSubscriptionWithContext(ctx context.Context) ([]ViewSubscriptionResponse, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Subscription)
+	defer cancel()
 	q := url.Values{
 		"client_id":     {strconv.Itoa(s.clientID)},
 		"client_secret": {s.clientSecret},
 	}
-	url, err := url.Parse(baseURL + subscriptionPath)
+	request, err := s.newRequest(ctx, http.MethodGet, subscriptionPath+"?"+q.Encode(), nil)
 	if err != nil {
 		return nil, err
 	}
-	url.RawQuery = q.Encode()
-	resp, err := s.client.Get(url.String())
+	resp, err := s.doWithRetry(request)
 	if err != nil {
 		return nil, err
 	}
@@ -93,7 +108,7 @@ func (s *API) ViewSubscription() ([]ViewSubscriptionResponse, error) {
 		return nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("strava: failed to get subscription: %s", string(respBody))
+		return nil, newAPIError("get subscription", resp, respBody, s.RateLimit())
 	}
 	var response []ViewSubscriptionResponse
 	err = json.Unmarshal(respBody, &response)
@@ -113,7 +128,12 @@ type deleteSubscriptionRequest struct {
 }
 
 func (s *API) DeleteSubscription(req DeleteSubscriptionRequest) error {
-	url := baseURL + subscriptionPath + "/" + strconv.Itoa(req.ID)
+	return s.DeleteSubscriptionWithContext(context.Background(), req)
+}
+
+func (s *API) DeleteSubscriptionWithContext(ctx context.Context, req DeleteSubscriptionRequest) error {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Subscription)
+	defer cancel()
 	r := deleteSubscriptionRequest{
 		ClientID:     s.clientID,
 		ClientSecret: s.clientSecret,
@@ -122,12 +142,12 @@ func (s *API) DeleteSubscription(req DeleteSubscriptionRequest) error {
 	if err != nil {
 		return err
 	}
-	deleteRequest, err := http.NewRequest(http.MethodDelete, url, bytes.NewBuffer(reqBody))
+	deleteRequest, err := s.newRequest(ctx, http.MethodDelete, subscriptionPath+"/"+strconv.Itoa(req.ID), bytes.NewBuffer(reqBody))
 	if err != nil {
 		return err
 	}
 	deleteRequest.Header.Set("Content-Type", "application/json")
-	resp, err := s.client.Do(deleteRequest)
+	resp, err := s.do(deleteRequest)
 	if err != nil {
 		return err
 	}
@@ -137,7 +157,7 @@ func (s *API) DeleteSubscription(req DeleteSubscriptionRequest) error {
 		return err
 	}
 	if resp.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("strava: failed to delete subscription: %s", string(respBody))
+		return newAPIError("delete subscription", resp, respBody, s.RateLimit())
 	}
 	return nil
 }
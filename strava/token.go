@@ -2,13 +2,20 @@ package strava
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 )
 
-const tokenPath = "/oauth/token"
+const (
+	tokenPath     = "/oauth/token"
+	authorizePath = "/oauth/authorize"
+)
 
 type RefreshTokenRequest struct {
 	RefreshToken string
@@ -28,7 +35,18 @@ type RefreshTokenResponse struct {
 	RefreshToken string `json:"refresh_token"`
 }
 
+// String redacts the tokens, so it's safe to log.
+func (r RefreshTokenResponse) String() string {
+	return fmt.Sprintf("{AccessToken:[redacted] ExpiresAt:%d ExpiresIn:%d RefreshToken:[redacted]}", r.ExpiresAt, r.ExpiresIn)
+}
+
 func (s *API) RefreshToken(req RefreshTokenRequest) (*RefreshTokenResponse, error) {
+	return s.RefreshTokenWithContext(context.Background(), req)
+}
+
+func (s *API) RefreshTokenWithContext(ctx context.Context, req RefreshTokenRequest) (*RefreshTokenResponse, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.RefreshToken)
+	defer cancel()
 	r := refreshTokenRequest{
 		ClientID:     s.clientID,
 		ClientSecret: s.clientSecret,
@@ -39,8 +57,12 @@ func (s *API) RefreshToken(req RefreshTokenRequest) (*RefreshTokenResponse, erro
 	if err != nil {
 		return nil, err
 	}
-	url := baseURL + tokenPath
-	resp, err := s.client.Post(url, "application/json", bytes.NewBuffer(reqBody))
+	request, err := s.newRequest(ctx, http.MethodPost, tokenPath, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	resp, err := s.doWithRetry(request)
 	if err != nil {
 		return nil, err
 	}
@@ -50,7 +72,7 @@ func (s *API) RefreshToken(req RefreshTokenRequest) (*RefreshTokenResponse, erro
 		return nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("strava: failed to refresh token: %s", string(respBody))
+		return nil, newAPIError("refresh token", resp, respBody, s.RateLimit())
 	}
 	var response RefreshTokenResponse
 	err = json.Unmarshal(respBody, &response)
@@ -59,3 +81,95 @@ func (s *API) RefreshToken(req RefreshTokenRequest) (*RefreshTokenResponse, erro
 	}
 	return &response, nil
 }
+
+// OAuth scopes, see https://developers.strava.com/docs/authentication/#detailsaboutrequestingaccess
+const (
+	ScopeRead            = "read"
+	ScopeReadAll         = "read_all"
+	ScopeProfileReadAll  = "profile:read_all"
+	ScopeActivityRead    = "activity:read"
+	ScopeActivityReadAll = "activity:read_all"
+)
+
+// AuthorizeURL returns the URL to send an athlete to so they can grant us access.
+// Strava redirects back to redirectURI with the given state, an authorization
+// code to pass to ExchangeCode, and the scopes the athlete granted.
+func (s *API) AuthorizeURL(redirectURI string, scopes []string, state string) string {
+	q := url.Values{
+		"client_id":       {strconv.Itoa(s.clientID)},
+		"redirect_uri":    {redirectURI},
+		"response_type":   {"code"},
+		"approval_prompt": {"auto"},
+		"scope":           {strings.Join(scopes, ",")},
+		"state":           {state},
+	}
+	return s.baseURL + authorizePath + "?" + q.Encode()
+}
+
+type ExchangeCodeRequest struct {
+	Code string
+}
+
+type exchangeCodeRequest struct {
+	ClientID     int    `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	Code         string `json:"code"`
+	GrantType    string `json:"grant_type"`
+}
+
+type ExchangeCodeResponse struct {
+	AccessToken  string         `json:"access_token"`
+	ExpiresAt    int            `json:"expires_at"`
+	ExpiresIn    int            `json:"expires_in"`
+	RefreshToken string         `json:"refresh_token"`
+	Athlete      SummaryAthlete `json:"athlete"`
+}
+
+// String redacts the tokens, so it's safe to log.
+func (r ExchangeCodeResponse) String() string {
+	return fmt.Sprintf("{AccessToken:[redacted] ExpiresAt:%d ExpiresIn:%d RefreshToken:[redacted] Athlete:%+v}", r.ExpiresAt, r.ExpiresIn, r.Athlete)
+}
+
+func (s *API) ExchangeCode(req ExchangeCodeRequest) (*ExchangeCodeResponse, error) {
+	return s.ExchangeCodeWithContext(context.Background(), req)
+}
+
+// ExchangeCodeWithContext completes the OAuth flow, exchanging an authorization
+// code for the athlete's tokens. Codes are single use, so this isn't retried.
+func (s *API) ExchangeCodeWithContext(ctx context.Context, req ExchangeCodeRequest) (*ExchangeCodeResponse, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.RefreshToken)
+	defer cancel()
+	r := exchangeCodeRequest{
+		ClientID:     s.clientID,
+		ClientSecret: s.clientSecret,
+		Code:         req.Code,
+		GrantType:    "authorization_code",
+	}
+	reqBody, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	request, err := s.newRequest(ctx, http.MethodPost, tokenPath, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	resp, err := s.do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError("exchange code", resp, respBody, s.RateLimit())
+	}
+	var response ExchangeCodeResponse
+	err = json.Unmarshal(respBody, &response)
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
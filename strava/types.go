@@ -6,6 +6,14 @@ type MetaAthlete struct {
 	ID int `json:"id"`
 }
 
+// Ignoring some fields because we don't care about them.
+type SummaryAthlete struct {
+	ID        int    `json:"id"`
+	Username  string `json:"username"`
+	Firstname string `json:"firstname"`
+	Lastname  string `json:"lastname"`
+}
+
 type LatLong [2]float64
 
 type ActivityType string
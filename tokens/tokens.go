@@ -0,0 +1,141 @@
+package tokens
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/kwoodhouse93/trail-progress-worker/store"
+	"github.com/kwoodhouse93/trail-progress-worker/strava"
+	"github.com/pkg/errors"
+)
+
+// ErrDeauthorized is returned when the athlete has not authorized us, or has
+// revoked our access. No further Strava calls should be made for them.
+var ErrDeauthorized = errors.New("tokens: athlete has not authorized access")
+
+// Manager hands out athletes' Strava access tokens, refreshing them when needed.
+//
+// Refreshes for the same athlete are deduplicated, both within this process
+// and, via a row lock in the store, across instances.
+type Manager struct {
+	stravaAPI *strava.API
+	store     *store.Store
+	// Refresh tokens this long before they expire.
+	margin time.Duration
+
+	mu       sync.Mutex
+	inflight map[int]*refreshCall
+}
+
+type refreshCall struct {
+	done  chan struct{}
+	token *store.AccessToken
+	err   error
+}
+
+func New(stravaAPI *strava.API, store *store.Store, margin time.Duration) *Manager {
+	return &Manager{
+		stravaAPI: stravaAPI,
+		store:     store,
+		margin:    margin,
+		inflight:  map[int]*refreshCall{},
+	}
+}
+
+// Gets the user's access token, refreshing it if it expires within the margin.
+func (m *Manager) AccessToken(ctx context.Context, athleteID int) (*store.AccessToken, error) {
+	token, err := m.store.GetAccessToken(ctx, athleteID)
+	if err != nil {
+		if errors.Is(err, store.ErrNoTokens) {
+			return nil, ErrDeauthorized
+		}
+		return nil, errors.Wrap(err, "tokens: failed to get access token")
+	}
+	log.Printf("tokens: got access token for athlete %d: %v", athleteID, token)
+
+	if !m.due(*token) {
+		return token, nil
+	}
+	return m.refresh(ctx, athleteID)
+}
+
+func (m *Manager) due(token store.AccessToken) bool {
+	return token.ExpiresWithin(m.margin)
+}
+
+// Refreshes the athlete's tokens, or waits for a refresh already in progress
+// in this process.
+func (m *Manager) refresh(ctx context.Context, athleteID int) (*store.AccessToken, error) {
+	m.mu.Lock()
+	if call, ok := m.inflight[athleteID]; ok {
+		m.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.token, call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	call := &refreshCall{done: make(chan struct{})}
+	m.inflight[athleteID] = call
+	m.mu.Unlock()
+
+	call.token, call.err = m.refreshLocked(ctx, athleteID)
+
+	m.mu.Lock()
+	delete(m.inflight, athleteID)
+	m.mu.Unlock()
+	close(call.done)
+
+	return call.token, call.err
+}
+
+func (m *Manager) refreshLocked(ctx context.Context, athleteID int) (*store.AccessToken, error) {
+	var refreshErr error
+	token, err := m.store.RefreshTokens(ctx, athleteID, m.due, func(refreshToken string) (*store.RefreshedTokens, error) {
+		log.Printf("tokens: token for athlete %d due to expire, refreshing", athleteID)
+		resp, err := m.stravaAPI.RefreshTokenWithContext(ctx, strava.RefreshTokenRequest{
+			RefreshToken: refreshToken,
+		})
+		if err != nil {
+			refreshErr = err
+			return nil, err
+		}
+		log.Printf("tokens: refreshed token for athlete %d: %v", athleteID, resp)
+		return &store.RefreshedTokens{
+			AccessToken:  resp.AccessToken,
+			RefreshToken: resp.RefreshToken,
+			ExpiresAt:    time.UnixMilli(int64(resp.ExpiresAt * 1000)),
+		}, nil
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrNoTokens) {
+			return nil, ErrDeauthorized
+		}
+		if refreshErr != nil {
+			// Deauthorize after the store has released its lock.
+			if strava.IsInvalidGrant(refreshErr) {
+				return nil, m.deauthorize(ctx, athleteID, refreshErr)
+			}
+			return nil, errors.Wrap(refreshErr, "tokens: failed to refresh token")
+		}
+		return nil, errors.Wrap(err, "tokens: failed to store tokens")
+	}
+	log.Printf("tokens: access token for athlete %d valid until %v", athleteID, token.ExpiresAt)
+	return token, nil
+}
+
+// The athlete has probably revoked our access outside of the webhook flow, so
+// we won't get a deauthorization event. Rather than deleting their data on the
+// strength of a failed refresh, delete their tokens, so we stop calling Strava
+// for them, and record that they need to authorize us again.
+func (m *Manager) deauthorize(ctx context.Context, athleteID int, cause error) error {
+	log.Printf("tokens: refresh token for athlete %d rejected, deleting tokens: %v", athleteID, cause)
+	err := m.store.SetDeauthorized(ctx, athleteID, "refresh token rejected")
+	if err != nil {
+		return errors.Wrap(err, "tokens: failed to record athlete as deauthorized")
+	}
+	return ErrDeauthorized
+}
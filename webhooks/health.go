@@ -0,0 +1,77 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Published on /debug/vars. Updated by the leader when it checks the subscription.
+var subscriptionMetrics = expvar.NewMap("webhook_subscription")
+
+type healthResponse struct {
+	SubscriptionID int        `json:"subscription_id"`
+	LastEventAt    *time.Time `json:"last_event_at"`
+	// Seconds since the last event was received, if there has been one.
+	LastEventAge *float64 `json:"last_event_age_seconds,omitempty"`
+	Warning      string   `json:"warning,omitempty"`
+}
+
+// Checks how long it's been since we last received an event, from any
+// instance, and warns if it's longer than the threshold.
+func (s Server) checkLastEvent(ctx context.Context) (*healthResponse, error) {
+	lastEventAt, err := s.store.LastWebhookEventAt(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "webhooks: failed to get last event time")
+	}
+	health := &healthResponse{
+		SubscriptionID: s.currentSubscriptionID(),
+		LastEventAt:    lastEventAt,
+	}
+	if lastEventAt == nil {
+		return health, nil
+	}
+
+	age := time.Since(*lastEventAt)
+	seconds := age.Seconds()
+	health.LastEventAge = &seconds
+	ageMetric := new(expvar.Int)
+	ageMetric.Set(int64(seconds))
+	subscriptionMetrics.Set("last_event_age_seconds", ageMetric)
+
+	stale := new(expvar.Int)
+	if s.config.EventWarningThreshold > 0 && age > s.config.EventWarningThreshold {
+		health.Warning = fmt.Sprintf("no webhook events received for %v", age.Round(time.Minute))
+		stale.Set(1)
+	}
+	subscriptionMetrics.Set("events_stale", stale)
+	return health, nil
+}
+
+// Reports the subscription ID and when we last received an event. Always
+// responds 200 if it can check, since a quiet period isn't a reason to
+// restart the instance.
+func (s Server) handleHealth() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		health, err := s.checkLastEvent(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			log.Printf("webhooks: health check failed: %v", err)
+			return
+		}
+		respBody, err := json.Marshal(health)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Printf("webhooks: failed to marshal health response: %v", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(respBody)
+	}
+}
@@ -0,0 +1,180 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/kwoodhouse93/trail-progress-worker/strava"
+	"github.com/pkg/errors"
+)
+
+const (
+	// How long a worker may spend processing a single event.
+	eventTimeout = time.Minute
+	// Events still processing after this long are assumed abandoned and claimed again.
+	eventLease = 5 * time.Minute
+
+	retryBaseDelay = 30 * time.Second
+	retryMaxDelay  = time.Hour
+)
+
+// Published on /debug/vars.
+var inboxMetrics = expvar.NewMap("webhook_events")
+
+// permanentError marks errors that won't be fixed by retrying the event.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error {
+	return permanentError{err: err}
+}
+
+// ServeInbox runs a pool of workers processing events from the webhook_events
+// table until ctx is done. Workers poll for due events, and are woken early
+// when the server receives a new event.
+func (s Server) ServeInbox(ctx context.Context) {
+	log.Printf("webhooks: starting %d inbox worker(s)", s.config.InboxWorkers)
+	var wg sync.WaitGroup
+	for i := 0; i < s.config.InboxWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.inboxWorker(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s Server) inboxWorker(ctx context.Context) {
+	ticker := time.NewTicker(s.config.InboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Keep going while there are due events, then wait.
+		for {
+			n, err := s.processInboxBatch(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("webhooks: failed to process inbox: %v", err)
+				break
+			}
+			if n == 0 {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.inboxWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Claims and processes a batch of due events, returning how many were claimed.
+func (s Server) processInboxBatch(ctx context.Context) (int, error) {
+	events, err := s.store.ClaimWebhookEvents(ctx, 1, eventLease)
+	if err != nil {
+		return 0, errors.Wrap(err, "webhooks: failed to claim events")
+	}
+	for _, event := range events {
+		s.processInboxEvent(ctx, event.ID, event.Payload, event.Attempts)
+	}
+	return len(events), nil
+}
+
+func (s Server) processInboxEvent(ctx context.Context, id int64, payload []byte, attempts int) {
+	var req webhookRequest
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		err = permanent(errors.Wrap(err, "webhooks: failed to unmarshal event"))
+	} else {
+		eventCtx, cancel := context.WithTimeout(ctx, eventTimeout)
+		err = s.processEvent(eventCtx, req)
+		cancel()
+	}
+
+	// Record the outcome even if we're shutting down, so the event isn't
+	// left waiting for its lease to expire.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err == nil {
+		inboxMetrics.Add("processed", 1)
+		err = s.store.CompleteWebhookEvent(ctx, id)
+		if err != nil {
+			log.Printf("webhooks: failed to mark event %d as done: %v", id, err)
+		}
+		return
+	}
+
+	// The daily limit can take hours to reset, longer than we'd keep retrying
+	// for, so wait for it rather than using up the event's attempts.
+	if strava.IsRateLimited(err) {
+		resumeAt := rateLimitResetsAt(s.stravaAPI.RateLimit())
+		inboxMetrics.Add("deferred", 1)
+		log.Printf("webhooks: rate limited processing event %d, deferring until %v: %v", id, resumeAt, err)
+		err = s.store.DeferWebhookEvent(ctx, id, err.Error(), resumeAt)
+		if err != nil {
+			log.Printf("webhooks: failed to defer event %d: %v", id, err)
+		}
+		return
+	}
+
+	var retryAt *time.Time
+	var perm permanentError
+	if !errors.As(err, &perm) && attempts < s.config.InboxMaxAttempts {
+		t := time.Now().Add(retryDelay(attempts))
+		retryAt = &t
+		inboxMetrics.Add("retried", 1)
+		log.Printf("webhooks: failed to process event %d (attempt %d), retrying at %v: %v", id, attempts, t, err)
+	} else {
+		inboxMetrics.Add("failed", 1)
+		log.Printf("webhooks: failed to process event %d (attempt %d), giving up: %v", id, attempts, err)
+	}
+	err = s.store.FailWebhookEvent(ctx, id, err.Error(), retryAt)
+	if err != nil {
+		log.Printf("webhooks: failed to record failure of event %d: %v", id, err)
+	}
+}
+
+// Exponential backoff from retryBaseDelay, capped at retryMaxDelay.
+func retryDelay(attempts int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempts && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay
+}
+
+// When the exhausted rate limit resets. Strava may reject requests without
+// telling us our usage, so assume the short term limit if neither looks
+// exhausted.
+func rateLimitResetsAt(rateLimit strava.RateLimit) time.Time {
+	if rateLimit.LongTermExhausted() {
+		return rateLimit.LongTermResetsAt()
+	}
+	return rateLimit.ShortTermResetsAt()
+}
+
+// Wakes an idle inbox worker, if there is one.
+func (s Server) wakeInbox() {
+	select {
+	case s.inboxWake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,208 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kwoodhouse93/trail-progress-worker/store"
+	"github.com/kwoodhouse93/trail-progress-worker/strava"
+	"github.com/pkg/errors"
+)
+
+const (
+	oauthAuthorizePath = "/oauth/authorize"
+	oauthCallbackPath  = "/oauth/callback"
+
+	oauthStateLifetime = 10 * time.Minute
+	// Holds the state's nonce, tying the callback to the browser that started
+	// the flow.
+	oauthStateCookie = "oauth_state"
+)
+
+// Scopes we ask athletes to grant. activity:read_all is needed to see
+// activities they've made private.
+var oauthScopes = []string{strava.ScopeRead, strava.ScopeActivityReadAll}
+
+type Backfiller interface {
+	Enqueue(ctx context.Context, athleteID int) error
+}
+
+func (s Server) oauthRedirectURL() string {
+	return strings.TrimSuffix(s.config.CallbackURL, "/") + oauthCallbackPath
+}
+
+// Redirects the athlete to Strava to authorize us.
+func (s Server) handleOAuthAuthorize() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		state, nonce, err := s.newOAuthState(time.Now())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Printf("webhooks: failed to generate oauth state: %v", err)
+			return
+		}
+		s.setOAuthStateCookie(w, nonce, int(oauthStateLifetime.Seconds()))
+		http.Redirect(w, r, s.stravaAPI.AuthorizeURL(s.oauthRedirectURL(), oauthScopes, state), http.StatusFound)
+	}
+}
+
+// Handles Strava's redirect back to us after the athlete has authorized us.
+func (s Server) handleOAuthCallback() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		if q.Has("error") {
+			http.Error(w, "authorization was not granted", http.StatusBadRequest)
+			log.Println("webhooks: oauth callback received error:", q.Get("error"))
+			return
+		}
+		// The state is single use, whatever happens next.
+		s.setOAuthStateCookie(w, "", -1)
+		var nonce string
+		if cookie, err := r.Cookie(oauthStateCookie); err == nil {
+			nonce = cookie.Value
+		}
+		if !s.validOAuthState(q.Get("state"), nonce, time.Now()) {
+			http.Error(w, "invalid or expired state", http.StatusBadRequest)
+			log.Println("webhooks: oauth callback received invalid state")
+			return
+		}
+		if !q.Has("code") {
+			http.Error(w, "missing code", http.StatusBadRequest)
+			log.Println("webhooks: oauth callback received no code")
+			return
+		}
+
+		athleteID, err := s.onboardAthlete(r.Context(), q.Get("code"), strings.Split(q.Get("scope"), ","))
+		if err != nil {
+			http.Error(w, "failed to connect to Strava", http.StatusInternalServerError)
+			log.Printf("webhooks: failed to onboard athlete: %v", err)
+			return
+		}
+		log.Println("webhooks: onboarded athlete, ID:", athleteID)
+
+		if s.config.OAuthSuccessURL != "" {
+			http.Redirect(w, r, s.config.OAuthSuccessURL, http.StatusFound)
+			return
+		}
+		w.Write([]byte("Connected to Strava. You can close this page."))
+	}
+}
+
+// The path the browser sees for the callback, which may be under a prefix.
+func (s Server) oauthCallbackCookiePath() string {
+	u, err := url.Parse(s.oauthRedirectURL())
+	if err != nil || u.Path == "" {
+		return oauthCallbackPath
+	}
+	return u.Path
+}
+
+// A negative maxAge deletes the cookie. It's Lax, not Strict, so it's sent
+// when Strava redirects back to us.
+func (s Server) setOAuthStateCookie(w http.ResponseWriter, nonce string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    nonce,
+		Path:     s.oauthCallbackCookiePath(),
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(s.config.CallbackURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (s Server) onboardAthlete(ctx context.Context, code string, scopes []string) (int, error) {
+	resp, err := s.stravaAPI.ExchangeCodeWithContext(ctx, strava.ExchangeCodeRequest{
+		Code: code,
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "webhooks: failed to exchange code")
+	}
+	athleteID := resp.Athlete.ID
+
+	err = s.store.CreateAthlete(
+		ctx,
+		athleteID,
+		resp.AccessToken,
+		resp.RefreshToken,
+		time.UnixMilli(int64(resp.ExpiresAt*1000)),
+		scopes,
+	)
+	if err != nil {
+		return 0, errors.Wrap(err, "webhooks: failed to create athlete")
+	}
+	token := store.AccessToken{Scopes: scopes}
+	if !token.HasScope(strava.ScopeActivityRead) {
+		// Nothing to backfill without access to their activities.
+		return athleteID, s.needsReauthorization(ctx, athleteID, "activity:read scope not granted")
+	}
+
+	// The athlete is set up at this point, so don't fail if we can't start
+	// the backfill. It can be started manually later.
+	err = s.backfiller.Enqueue(ctx, athleteID)
+	if err != nil {
+		log.Printf("webhooks: failed to start backfill for athlete %d: %v", athleteID, err)
+	}
+	return athleteID, nil
+}
+
+// OAuth state is "{nonce}.{expiry}.{signature}", signed with the configured
+// secret so any instance can validate it without storing anything. The nonce
+// is also returned, to be set in a cookie, so a state can only be used by the
+// browser it was issued to.
+func (s Server) newOAuthState(now time.Time) (string, string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", "", err
+	}
+	nonce := hex.EncodeToString(b)
+	payload := nonce + "." + strconv.FormatInt(now.Add(oauthStateLifetime).Unix(), 10)
+	return payload + "." + s.signOAuthState(payload), nonce, nil
+}
+
+// nonce is the value of the browser's state cookie.
+func (s Server) validOAuthState(state, nonce string, now time.Time) bool {
+	i := strings.LastIndex(state, ".")
+	if i < 0 {
+		return false
+	}
+	payload, signature := state[:i], state[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(s.signOAuthState(payload))) {
+		return false
+	}
+	parts := strings.Split(payload, ".")
+	if len(parts) != 2 {
+		return false
+	}
+	if nonce == "" || !hmac.Equal([]byte(parts[0]), []byte(nonce)) {
+		return false
+	}
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return false
+	}
+	return now.Before(time.Unix(expiry, 0))
+}
+
+func (s Server) signOAuthState(payload string) string {
+	mac := hmac.New(sha256.New, []byte(s.config.OAuthStateSecret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
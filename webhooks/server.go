@@ -2,15 +2,18 @@ package webhooks
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"time"
+	"path"
+	"sync/atomic"
 
 	"github.com/kwoodhouse93/trail-progress-worker/store"
 	"github.com/kwoodhouse93/trail-progress-worker/strava"
+	"github.com/kwoodhouse93/trail-progress-worker/tokens"
 	"github.com/pkg/errors"
 )
 
@@ -18,10 +21,17 @@ type Server struct {
 	server      *http.Server
 	stravaAPI   *strava.API
 	store       *store.Store
+	tokens      *tokens.Manager
+	backfiller  Backfiller
 	verifyToken string
+	config      Config
+	inboxWake   chan struct{}
+	// ID of our subscription, once Strava has created it. Events for any
+	// other subscription are rejected.
+	subscriptionID *int64
 }
 
-func NewServer(addr string, stravaAPI *strava.API, store *store.Store, verifyToken string) *Server {
+func NewServer(addr string, stravaAPI *strava.API, store *store.Store, tokens *tokens.Manager, backfiller Backfiller, verifyToken string, config Config) *Server {
 	s := &http.Server{
 		Addr: addr,
 	}
@@ -30,13 +40,50 @@ func NewServer(addr string, stravaAPI *strava.API, store *store.Store, verifyTok
 		server:      s,
 		stravaAPI:   stravaAPI,
 		store:       store,
+		tokens:      tokens,
+		backfiller:  backfiller,
 		verifyToken: verifyToken,
+		config:      config,
+		inboxWake:   make(chan struct{}, 1),
+
+		subscriptionID: new(int64),
+	}
+}
+
+// SetSubscriptionID sets the ID of the subscription we accept events for.
+func (s Server) SetSubscriptionID(id int) {
+	atomic.StoreInt64(s.subscriptionID, int64(id))
+}
+
+func (s Server) currentSubscriptionID() int {
+	return int(atomic.LoadInt64(s.subscriptionID))
+}
+
+// Checks id is the ID of our subscription. Another instance may have created
+// the subscription since we last looked, so checks the store before
+// concluding it isn't.
+func (s Server) isOurSubscription(ctx context.Context, id int) (bool, error) {
+	if id != 0 && id == s.currentSubscriptionID() {
+		return true, nil
+	}
+	sub, err := s.store.GetWebhookSubscription(ctx, s.config.CallbackURL)
+	if err != nil {
+		return false, err
 	}
+	s.SetSubscriptionID(sub.ID)
+	return sub.ID != 0 && id == sub.ID, nil
 }
 
 func (s Server) Serve() error {
 	log.Println("webhooks: starting webhook server")
-	s.server.Handler = s.handleWebhooks()
+	mux := http.NewServeMux()
+	mux.Handle("/health", s.handleHealth())
+	if s.config.OAuthStateSecret != "" {
+		mux.Handle(oauthAuthorizePath, s.handleOAuthAuthorize())
+		mux.Handle(oauthCallbackPath, s.handleOAuthCallback())
+	}
+	mux.Handle("/", s.handleWebhooks())
+	s.server.Handler = mux
 	return s.server.ListenAndServe()
 }
 
@@ -44,8 +91,17 @@ func (s Server) Shutdown(ctx context.Context) error {
 	return s.server.Shutdown(ctx)
 }
 
+func (s Server) Close() error {
+	return s.server.Close()
+}
+
 func (s Server) handleWebhooks() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.validCallbackPath(r.URL.Path) {
+			w.WriteHeader(http.StatusNotFound)
+			rejectEvent(r, "incorrect callback path")
+			return
+		}
 		if r.Method == http.MethodGet {
 			s.handleSubscriptionValidation()(w, r)
 			return
@@ -58,6 +114,21 @@ func (s Server) handleWebhooks() http.HandlerFunc {
 	}
 }
 
+// Checks the request was made to the callback URL including the secret, if
+// there is one. The secret is the last element of the path.
+func (s Server) validCallbackPath(p string) bool {
+	if s.config.CallbackSecret == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(path.Base(p)), []byte(s.config.CallbackSecret)) == 1
+}
+
+// Logs and counts a request we've refused to handle.
+func rejectEvent(r *http.Request, reason string) {
+	inboxMetrics.Add("rejected", 1)
+	log.Printf("webhooks: rejected %s request from %s: %s", r.Method, r.RemoteAddr, reason)
+}
+
 type subscriptionValidationResponse struct {
 	Challenge string `json:"hub.challenge"`
 }
@@ -160,11 +231,17 @@ func (u updates) Private() (*bool, error) {
 	if !ok {
 		return nil, nil
 	}
-	private, ok := value.(bool)
-	if !ok {
-		return nil, fmt.Errorf("webhooks: failed to parse private update: %v", value)
+	// Strava's docs show it as a string, but accept a bool too.
+	switch private := value.(type) {
+	case bool:
+		return &private, nil
+	case string:
+		if private == "true" || private == "false" {
+			b := private == "true"
+			return &b, nil
+		}
 	}
-	return &private, nil
+	return nil, fmt.Errorf("webhooks: failed to parse private update: %v", value)
 }
 
 // Returns (true, nil)  if `"authorized": "false"` was received
@@ -195,6 +272,17 @@ type webhookRequest struct {
 	EventTime      int        `json:"event_time"`
 }
 
+func (r webhookRequest) key() store.WebhookEventKey {
+	return store.WebhookEventKey{
+		ObjectType: string(r.ObjectType),
+		ObjectID:   r.ObjectID,
+		AspectType: string(r.AspectType),
+		EventTime:  r.EventTime,
+	}
+}
+
+// Stores the event in the inbox and acknowledges it straight away. Strava
+// expects a response within two seconds, so processing happens asynchronously.
 func (s Server) handleEvent() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		reqBody, err := ioutil.ReadAll(r.Body)
@@ -212,102 +300,190 @@ func (s Server) handleEvent() http.HandlerFunc {
 		}
 		log.Printf("webhooks: received event: %+v\n", req)
 
-		switch req.ObjectType {
-		case ObjectTypeActivity:
-			switch req.AspectType {
-			case AspectTypeCreate:
-				err := s.handleCreateActivity(r.Context(), req)
-				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					log.Printf("webhooks: failed to handle create activity event: %v", err)
-					return
-				}
-			case AspectTypeUpdate:
-				err := s.handleUpdateActivity(r.Context(), req)
-				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					log.Printf("webhooks: failed to handle update activity event: %v", err)
-					return
-				}
-			case AspectTypeDelete:
-				err := s.handleDeleteActivity(r.Context(), req)
-				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					log.Printf("webhooks: failed to handle delete activity event: %v", err)
-					return
-				}
-			default:
-				w.WriteHeader(http.StatusBadRequest)
-				log.Printf("webhooks: received activity event with unexpected aspect type: %v", req.AspectType)
-				return
-			}
-		case ObjectTypeAthlete:
-			switch req.AspectType {
-			case AspectTypeUpdate:
-				err := s.handleUpdateAthlete(r.Context(), req)
-				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					log.Printf("webhooks: failed to handle update athlete event: %v", err)
-					return
-				}
-			default:
-				w.WriteHeader(http.StatusBadRequest)
-				log.Printf("webhooks: received athlete event with unexpected aspect type: %v", req.AspectType)
+		// Anyone who knows the callback URL can post to it, so only accept
+		// events for the subscription we created.
+		ours, err := s.isOurSubscription(r.Context(), req.SubscriptionID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Printf("webhooks: failed to get subscription: %v", err)
+			return
+		}
+		if !ours {
+			if s.currentSubscriptionID() == 0 {
+				// We haven't finished creating the subscription. Strava will redeliver the event.
+				w.WriteHeader(http.StatusServiceUnavailable)
+				rejectEvent(r, "subscription not created yet")
 				return
 			}
-		default:
-			w.WriteHeader(http.StatusBadRequest)
-			log.Printf("webhooks: received event with unexpected object type: %v", req.ObjectType)
+			w.WriteHeader(http.StatusForbidden)
+			rejectEvent(r, fmt.Sprintf("unexpected subscription ID %d", req.SubscriptionID))
+			return
+		}
+
+		id, created, err := s.store.StoreWebhookEvent(r.Context(), req.key(), reqBody)
+		if err != nil {
+			// Strava will redeliver the event.
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Printf("webhooks: failed to store event: %v", err)
 			return
 		}
+		if created {
+			inboxMetrics.Add("received", 1)
+			log.Println("webhooks: stored event, ID:", id)
+			s.wakeInbox()
+		} else {
+			// Still acknowledge it, or Strava will keep redelivering it.
+			inboxMetrics.Add("duplicates", 1)
+			log.Printf("webhooks: already received event, ignoring: %+v", req.key())
+		}
 
 		// Respond with 200 OK to acknowledge the event
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
+func (s Server) processEvent(ctx context.Context, req webhookRequest) error {
+	switch req.ObjectType {
+	case ObjectTypeActivity:
+		switch req.AspectType {
+		case AspectTypeCreate:
+			return errors.Wrap(s.handleCreateActivity(ctx, req), "webhooks: failed to handle create activity event")
+		case AspectTypeUpdate:
+			return errors.Wrap(s.handleUpdateActivity(ctx, req), "webhooks: failed to handle update activity event")
+		case AspectTypeDelete:
+			return errors.Wrap(s.handleDeleteActivity(ctx, req), "webhooks: failed to handle delete activity event")
+		default:
+			return permanent(errors.Errorf("webhooks: received activity event with unexpected aspect type: %v", req.AspectType))
+		}
+	case ObjectTypeAthlete:
+		switch req.AspectType {
+		case AspectTypeUpdate:
+			return errors.Wrap(s.handleUpdateAthlete(ctx, req), "webhooks: failed to handle update athlete event")
+		default:
+			return permanent(errors.Errorf("webhooks: received athlete event with unexpected aspect type: %v", req.AspectType))
+		}
+	default:
+		return permanent(errors.Errorf("webhooks: received event with unexpected object type: %v", req.ObjectType))
+	}
+}
+
 func (s Server) handleCreateActivity(ctx context.Context, req webhookRequest) error {
+	return s.syncActivity(ctx, req)
+}
+
+// Updates can change anything about an activity, including its track, and
+// only some changes are described in the event. Fetch the whole activity
+// again rather than patching the fields we're told about.
+func (s Server) handleUpdateActivity(ctx context.Context, req webhookRequest) error {
+	log.Printf("webhooks: activity %d updated: %v", req.ObjectID, req.Updates)
+
+	// Record a change of visibility first, in case the activity is now
+	// private and we can't fetch it.
+	private, err := req.Updates.Private()
+	if err != nil {
+		return errors.Wrap(err, "webhooks: failed to get private from updates")
+	}
+	if private != nil {
+		err = s.store.SetActivityPrivate(ctx, req.OwnerID, req.ObjectID, req.EventTime, *private)
+		if err != nil {
+			return errors.Wrap(err, "webhooks: failed to set activity visibility")
+		}
+	}
+	return s.syncActivity(ctx, req)
+}
+
+// Fetches the activity from Strava and stores it, replacing our copy if we
+// have one.
+func (s Server) syncActivity(ctx context.Context, req webhookRequest) error {
+	// Don't spend a token refresh on an activity we can't fetch yet.
+	// Returning an error means the event will be retried later.
+	if rateLimit := s.stravaAPI.RateLimit(); rateLimit.Exhausted() {
+		log.Printf("webhooks: deferring fetch of activity %d, rate limit usage: %+v", req.ObjectID, rateLimit)
+		return errors.Wrap(strava.ErrRateLimited, "webhooks: deferring activity fetch")
+	}
+
 	token, err := s.AccessToken(ctx, req.OwnerID)
 	if err != nil {
+		if errors.Is(err, tokens.ErrDeauthorized) {
+			log.Printf("webhooks: athlete %d has deauthorized us, skipping activity %d", req.OwnerID, req.ObjectID)
+			return nil
+		}
 		return errors.Wrap(err, "webhooks: failed to get access token")
 	}
+	if !token.HasScope(strava.ScopeActivityRead) {
+		return s.needsReauthorization(ctx, req.OwnerID, "activity:read scope not granted")
+	}
 
-	resp, err := s.stravaAPI.GetActivity(strava.GetActivityRequest{
+	resp, err := s.stravaAPI.GetActivityWithContext(ctx, strava.GetActivityRequest{
 		AccessToken: token.Token,
 		ID:          req.ObjectID,
 	})
 	if err != nil {
+		// Retrying won't help if the activity is gone or we aren't allowed to see it,
+		// so finish with the event rather than have it retried.
+		if strava.IsNotFound(err) {
+			// Private activities look like they don't exist without activity:read_all.
+			if !token.HasScope(strava.ScopeActivityReadAll) {
+				return s.needsReauthorization(ctx, req.OwnerID, "activity:read_all scope not granted, private activities are not visible")
+			}
+			log.Printf("webhooks: activity %d no longer exists, skipping: %v", req.ObjectID, err)
+			return nil
+		}
+		if strava.IsUnauthorized(err) || strava.IsForbidden(err) {
+			return s.needsReauthorization(ctx, req.OwnerID, err.Error())
+		}
 		return errors.Wrap(err, "webhooks: failed to get activity")
 	}
-	log.Println("webhooks: got new activity, ID:", resp.ID)
+	log.Println("webhooks: got activity, ID:", resp.ID)
+
+	var detailedTrack []strava.LatLong
+	if s.config.FetchStreams && resp.Map.SummaryPolyline != "" {
+		detailedTrack, err = s.activityTrack(ctx, token.Token, req.ObjectID)
+		if err != nil {
+			return err
+		}
+	}
 
-	err = s.store.StoreActivity(ctx, req.OwnerID, resp.DetailedActivity)
+	err = s.store.StoreActivity(ctx, req.OwnerID, resp.DetailedActivity, detailedTrack, req.EventTime)
 	if err != nil {
 		return errors.Wrap(err, "webhooks: failed to store activity")
 	}
 	return nil
 }
 
-func (s Server) handleUpdateActivity(ctx context.Context, req webhookRequest) error {
-	t, err := req.Updates.Title()
+// Records that the athlete must authorize us again before we can fetch their
+// activities. The event is finished with, since retrying it won't help.
+func (s Server) needsReauthorization(ctx context.Context, athleteID int, reason string) error {
+	log.Printf("webhooks: athlete %d needs reauthorization: %s", athleteID, reason)
+	err := s.store.SetNeedsReauthorization(ctx, athleteID, reason)
 	if err != nil {
-		return errors.Wrap(err, "webhooks: failed to get title from updates")
+		return errors.Wrap(err, "webhooks: failed to record athlete needs reauthorization")
 	}
-	a, err := req.Updates.Type()
+	return nil
+}
+
+// Gets the full resolution GPS track for an activity.
+// Returns nil if the activity has no GPS stream.
+func (s Server) activityTrack(ctx context.Context, accessToken string, activityID int) ([]strava.LatLong, error) {
+	resp, err := s.stravaAPI.GetActivityStreamsWithContext(ctx, strava.GetActivityStreamsRequest{
+		AccessToken: accessToken,
+		ID:          activityID,
+		Keys:        []strava.StreamType{strava.StreamTypeLatLng},
+	})
 	if err != nil {
-		return errors.Wrap(err, "webhooks: failed to get activity type from updates")
+		if strava.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "webhooks: failed to get activity streams")
 	}
-	// Ignoring req.Updates.Private() because we don't do anything with it.
-	// No activities are accessible to anyone other than their owner.
-	err = s.store.UpdateActivity(ctx, req.OwnerID, req.ObjectID, t, a)
-	if err != nil {
-		return errors.Wrap(err, "webhooks: failed to update activity")
+	if resp.LatLng == nil {
+		return nil, nil
 	}
-	return nil
+	return resp.LatLng.Data, nil
 }
 
 func (s Server) handleDeleteActivity(ctx context.Context, req webhookRequest) error {
-	err := s.store.DeleteActivity(ctx, req.OwnerID, req.ObjectID)
+	err := s.store.DeleteActivity(ctx, req.OwnerID, req.ObjectID, req.EventTime)
 	if err != nil {
 		return errors.Wrap(err, "webhooks: failed to delete activity")
 	}
@@ -335,42 +511,5 @@ func (s Server) handleUpdateAthlete(ctx context.Context, req webhookRequest) err
 
 // Gets the user's access token, refreshing it if necessary.
 func (s Server) AccessToken(ctx context.Context, athleteID int) (*store.AccessToken, error) {
-	token, err := s.store.GetAccessToken(ctx, athleteID)
-	if err != nil {
-		return nil, errors.Wrap(err, "webhooks: failed to get access token")
-	}
-	log.Println("webhooks: got access token:", token)
-
-	if token.IsExpired() {
-		log.Println("webhooks: token expired, refreshing")
-		refreshToken, err := s.store.GetRefreshToken(ctx, athleteID)
-		if err != nil {
-			return nil, errors.Wrap(err, "webhooks: failed to get refresh token")
-		}
-		resp, err := s.stravaAPI.RefreshToken(strava.RefreshTokenRequest{
-			RefreshToken: refreshToken.Token,
-		})
-		if err != nil {
-			return nil, errors.Wrap(err, "webhooks: failed to refresh token")
-		}
-		log.Println("webhooks: refreshed token:", resp)
-
-		err = s.store.StoreTokens(
-			ctx,
-			athleteID,
-			resp.AccessToken,
-			resp.RefreshToken,
-			time.UnixMilli(int64(resp.ExpiresAt*1000)),
-		)
-		if err != nil {
-			return nil, errors.Wrap(err, "webhooks: failed to store tokens")
-		}
-		token = &store.AccessToken{
-			Token:     resp.AccessToken,
-			ExpiresAt: time.UnixMilli(int64(resp.ExpiresAt * 1000)),
-		}
-		log.Println("webhooks: stored refreshed token:", token.Token)
-	}
-
-	return token, nil
+	return s.tokens.AccessToken(ctx, athleteID)
 }
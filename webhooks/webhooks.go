@@ -3,70 +3,266 @@ package webhooks
 import (
 	"context"
 	"log"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/kwoodhouse93/trail-progress-worker/leader"
 	"github.com/kwoodhouse93/trail-progress-worker/store"
 	"github.com/kwoodhouse93/trail-progress-worker/strava"
+	"github.com/kwoodhouse93/trail-progress-worker/tokens"
+	"github.com/pkg/errors"
 )
 
-type Subscription struct {
-	id int
+type Config struct {
+	CallbackURL string
+	// Optional secret appended to the callback URL's path. Requests to any
+	// other path are rejected.
+	CallbackSecret string
+	// Whether to fetch and store full resolution GPS tracks for new activities.
+	FetchStreams bool
+	// Secret for signing OAuth state. The OAuth routes are disabled if empty.
+	OAuthStateSecret string
+	// Where to send athletes after they've connected their Strava account.
+	OAuthSuccessURL string
+	// Whether the leader deletes the subscription on shutdown. Leave it in
+	// place if another instance will take over, e.g. during a rolling deploy.
+	DeleteSubscriptionOnClose bool
+	// How often the leader checks the subscription still exists.
+	ReconcileInterval time.Duration
+	// Warn if no events have been received for this long.
+	EventWarningThreshold time.Duration
+
+	// Number of workers processing events from the inbox.
+	InboxWorkers int
+	// How often idle workers check for events due to be retried.
+	InboxPollInterval time.Duration
+	// How many times to attempt an event before giving up on it.
+	InboxMaxAttempts int
+}
 
-	server *Server
-	api    *strava.API
+// The callback URL to register with Strava, including the secret if there is one.
+func (c Config) subscriptionCallbackURL() string {
+	if c.CallbackSecret == "" {
+		return c.CallbackURL
+	}
+	return strings.TrimSuffix(c.CallbackURL, "/") + "/" + url.PathEscape(c.CallbackSecret)
 }
 
-// Must call Close() on the returned Subscription to remove the subscription on the Strava API.
-func NewSubscription(clientID int, clientSecret string, callbackURL string, store *store.Store) (*Subscription, error) {
-	stravaAPI := strava.NewAPI(clientID, clientSecret)
+// Retry sooner than the reconcile interval if reconciling fails.
+const reconcileRetryDelay = time.Minute
+
+// Subscription runs the webhook server, and manages our subscription on the
+// Strava API. Every instance serves webhooks, but only the leader manages the
+// subscription.
+type Subscription struct {
+	server  *Server
+	api     *strava.API
+	store   *store.Store
+	config  Config
+	elector *leader.Elector
+
+	stopManaging context.CancelFunc
+	managingDone chan struct{}
+	stopInbox    context.CancelFunc
+	inboxDone    chan struct{}
+}
 
-	verifyToken := uuid.NewString()
-	server := NewServer(":8080", stravaAPI, store, verifyToken)
+// Starts the webhook server, and campaigns to manage the subscription on the
+// Strava API using elector. When leader, makes sure a subscription exists,
+// reusing an existing one if it has our callback URL.
+//
+// Must call Close() on the returned Subscription to stop the server.
+func NewSubscription(ctx context.Context, stravaAPI *strava.API, store *store.Store, tokens *tokens.Manager, backfiller Backfiller, elector *leader.Elector, config Config) (*Subscription, error) {
+	stored, err := store.InitWebhookSubscription(ctx, config.CallbackURL, uuid.NewString())
+	if err != nil {
+		return nil, errors.Wrap(err, "webhooks: failed to get subscription")
+	}
+	server := NewServer(":8080", stravaAPI, store, tokens, backfiller, stored.VerifyToken, config)
+	server.SetSubscriptionID(stored.ID)
 	go server.Serve()
 
-	viewResp, err := stravaAPI.ViewSubscription()
+	inboxCtx, stopInbox := context.WithCancel(context.Background())
+	inboxDone := make(chan struct{})
+	go func() {
+		server.ServeInbox(inboxCtx)
+		close(inboxDone)
+	}()
+
+	s := &Subscription{
+		server:       server,
+		api:          stravaAPI,
+		store:        store,
+		config:       config,
+		elector:      elector,
+		managingDone: make(chan struct{}),
+		stopInbox:    stopInbox,
+		inboxDone:    inboxDone,
+	}
+	var manageCtx context.Context
+	manageCtx, s.stopManaging = context.WithCancel(context.Background())
+	go func() {
+		elector.Run(manageCtx, s.manage)
+		close(s.managingDone)
+	}()
+	return s, nil
+}
+
+// Runs while this instance is leader. Makes sure the subscription exists,
+// then checks it periodically.
+func (s *Subscription) manage(ctx context.Context) {
+	for {
+		delay := s.config.ReconcileInterval
+		err := s.reconcile(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("webhooks: failed to reconcile subscription: %v", err)
+			if reconcileRetryDelay < delay {
+				delay = reconcileRetryDelay
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Makes sure the subscription exists on the Strava API, and records its ID.
+func (s *Subscription) reconcile(ctx context.Context) error {
+	stored, err := s.store.GetWebhookSubscription(ctx, s.config.CallbackURL)
 	if err != nil {
-		log.Fatal(err)
+		return errors.Wrap(err, "webhooks: failed to get subscription")
 	}
-	log.Println("webhooks: current subscriptions", viewResp)
-	if len(viewResp) > 0 {
-		log.Println("webhooks: deleting existing subscription")
-		err = stravaAPI.DeleteSubscription(strava.DeleteSubscriptionRequest{
-			ID: viewResp[0].ID,
+	subscriptionMetrics.Add("checks", 1)
+	id, created, err := ensureSubscription(ctx, s.api, s.config.subscriptionCallbackURL(), stored.VerifyToken)
+	if err != nil {
+		subscriptionMetrics.Add("check_failures", 1)
+		return err
+	}
+	if stored.ID != 0 && id != stored.ID {
+		if created {
+			// Strava may drop subscriptions, e.g. if callbacks keep failing.
+			log.Printf("webhooks: subscription %d was missing, replaced it with %d", stored.ID, id)
+			subscriptionMetrics.Add("recreated", 1)
+		} else {
+			log.Printf("webhooks: expected subscription %d, but found %d with our callback URL", stored.ID, id)
+			subscriptionMetrics.Add("id_mismatches", 1)
+		}
+	}
+	s.server.SetSubscriptionID(id)
+	if id != stored.ID {
+		err = s.store.SetWebhookSubscriptionID(ctx, s.config.CallbackURL, id)
+		if err != nil {
+			return errors.Wrap(err, "webhooks: failed to store subscription ID")
+		}
+	}
+
+	// Events go quiet if Strava stops sending them without dropping the
+	// subscription, so warn if we haven't had any for a while.
+	health, err := s.server.checkLastEvent(ctx)
+	if err != nil {
+		return err
+	}
+	if health.Warning != "" {
+		log.Printf("webhooks: warning: %s, the subscription may not be working", health.Warning)
+	}
+	return nil
+}
+
+// Returns the ID of the subscription with our callback URL, creating it if
+// there isn't one, and whether it was created. Strava only allows one subscription per app, so one with
+// a different callback URL is deleted first.
+func ensureSubscription(ctx context.Context, stravaAPI *strava.API, callbackURL, verifyToken string) (int, bool, error) {
+	existing, err := stravaAPI.ViewSubscriptionWithContext(ctx)
+	if err != nil {
+		return 0, false, errors.Wrap(err, "webhooks: failed to get subscriptions")
+	}
+	log.Printf("webhooks: found %d existing subscription(s)", len(existing))
+	if id, ok := findSubscription(existing, callbackURL); ok {
+		log.Println("webhooks: reusing subscription with id", id)
+		return id, false, nil
+	}
+	for _, sub := range existing {
+		log.Println("webhooks: deleting subscription with different callback URL, id", sub.ID)
+		err = stravaAPI.DeleteSubscriptionWithContext(ctx, strava.DeleteSubscriptionRequest{
+			ID: sub.ID,
 		})
 		if err != nil {
-			log.Fatal(err)
+			return 0, false, errors.Wrap(err, "webhooks: failed to delete subscription")
 		}
 	}
 
-	createResp, err := stravaAPI.CreateSubscription(strava.CreateSubscriptionRequest{
+	createResp, err := stravaAPI.CreateSubscriptionWithContext(ctx, strava.CreateSubscriptionRequest{
 		CallbackURL: callbackURL,
 		VerifyToken: verifyToken,
 	})
 	if err != nil {
-		return nil, err
+		// Another instance may have created it since we looked.
+		existing, viewErr := stravaAPI.ViewSubscriptionWithContext(ctx)
+		if viewErr == nil {
+			if id, ok := findSubscription(existing, callbackURL); ok {
+				log.Println("webhooks: reusing subscription created elsewhere with id", id)
+				return id, false, nil
+			}
+		}
+		return 0, false, errors.Wrap(err, "webhooks: failed to create subscription")
 	}
 	log.Println("webhooks: subscription created with id", createResp.ID)
+	return createResp.ID, true, nil
+}
 
-	return &Subscription{
-		id:     createResp.ID,
-		server: server,
-		api:    stravaAPI,
-	}, nil
+func findSubscription(subs []strava.ViewSubscriptionResponse, callbackURL string) (int, bool) {
+	for _, sub := range subs {
+		if sub.CallbackURL == callbackURL {
+			return sub.ID, true
+		}
+	}
+	return 0, false
 }
 
+// Stops the server and gives up leadership. If we were leader, deletes the
+// subscription on the Strava API if configured to.
 func (s *Subscription) Close(ctx context.Context) error {
-	log.Println("webhooks: deleting subscription")
-	err := s.api.DeleteSubscription(strava.DeleteSubscriptionRequest{
-		ID: s.id,
-	})
-	if err != nil {
-		log.Println("webhooks: error while deleting subscription:", err)
+	wasLeader := s.elector.IsLeader()
+	s.stopManaging()
+	select {
+	case <-s.managingDone:
+	case <-ctx.Done():
 	}
 
-	err = s.server.Shutdown(ctx)
+	if wasLeader && s.config.DeleteSubscriptionOnClose {
+		log.Println("webhooks: deleting subscription")
+		err := s.api.DeleteSubscriptionWithContext(ctx, strava.DeleteSubscriptionRequest{
+			ID: s.server.currentSubscriptionID(),
+		})
+		if err != nil {
+			log.Println("webhooks: error while deleting subscription:", err)
+		} else {
+			err = s.store.SetWebhookSubscriptionID(ctx, s.config.CallbackURL, 0)
+			if err != nil {
+				log.Println("webhooks: error while recording subscription deleted:", err)
+			}
+		}
+	}
+
+	err := s.server.Shutdown(ctx)
 	if err != nil {
-		return err
+		// Drop any in-flight requests, cancelling their contexts and
+		// any Strava calls they're making.
+		s.server.Close()
 	}
-	return nil
+
+	// Events interrupted here are retried later, by us or another instance.
+	s.stopInbox()
+	select {
+	case <-s.inboxDone:
+	case <-ctx.Done():
+	}
+	return err
 }